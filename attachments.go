@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+// AttachmentLimits bounds the attachments of a request. MaxSize applies to
+// each attachment and MaxJobSize to all of a request's together, both
+// decoded. Attachments of LFSThreshold bytes or more are stored with Git LFS
+// on hosts that have it; 0 turns that off.
+type AttachmentLimits struct {
+	MaxSize      int64
+	MaxJobSize   int64
+	LFSThreshold int64
+}
+
+func LoadAttachmentLimits() AttachmentLimits {
+	return AttachmentLimits{
+		MaxSize:      EnvSize("ATTACHMENT_MAX_SIZE", 50<<20),
+		MaxJobSize:   EnvSize("JOB_ATTACHMENTS_MAX_SIZE", 100<<20),
+		LFSThreshold: EnvSize("ATTACHMENT_LFS_THRESHOLD", 10<<20),
+	}
+}
+
+// requestOverhead is what a request may carry besides its attachments' data:
+// the brief, checks, attachment names and JSON around them.
+const requestOverhead = 1 << 20
+
+// MaxRequestSize is the largest /ingest body that can hold MaxJobSize bytes
+// of attachments, base64-encoded, plus the rest of the request; 0 means no
+// limit. Bodies past it are cut off before they are read into memory.
+func (l AttachmentLimits) MaxRequestSize() int64 {
+	if l.MaxJobSize <= 0 {
+		return 0
+	}
+	return (l.MaxJobSize+2)/3*4 + requestOverhead
+}
+
+// AttachmentTooLargeError reports an attachment, or with no Attachment a
+// request's attachments as a whole, over its limit.
+type AttachmentTooLargeError struct {
+	Attachment string
+	Size       int64
+	Limit      int64
+}
+
+func (e *AttachmentTooLargeError) Code() string {
+	if e.Attachment == "" {
+		return "attachments_too_large"
+	}
+	return "attachment_too_large"
+}
+
+func (e *AttachmentTooLargeError) Error() string {
+	if e.Attachment == "" {
+		return fmt.Sprintf("%s: %d bytes in total, limit %d", e.Code(), e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%s:%s: %d bytes, limit %d", e.Code(), e.Attachment, e.Size, e.Limit)
+}
+
+// Check measures every attachment without decoding it. It fails with an
+// *AttachmentTooLargeError, or if an attachment isn't a base64 data: URL.
+func (l AttachmentLimits) Check(atts []Attachment) error {
+	var total int64
+
+	for _, att := range atts {
+		du, err := ParseDataURL(att.URL)
+		if err != nil {
+			return fmt.Errorf("invalid_attachment:%s: %w", att.Name, err)
+		}
+
+		size := du.Size()
+		if l.MaxSize > 0 && size > l.MaxSize {
+			return &AttachmentTooLargeError{Attachment: att.Name, Size: size, Limit: l.MaxSize}
+		}
+		total += size
+	}
+
+	if l.MaxJobSize > 0 && total > l.MaxJobSize {
+		return &AttachmentTooLargeError{Size: total, Limit: l.MaxJobSize}
+	}
+	return nil
+}
+
+// redactAttachments returns req with each attachment's data replaced by its
+// size, for logging.
+func redactAttachments(req UserRequest) UserRequest {
+	atts := make([]Attachment, len(req.Attachments))
+	for i, att := range req.Attachments {
+		atts[i] = Attachment{Name: att.Name, URL: "<invalid data URL>"}
+		if du, err := ParseDataURL(att.URL); err == nil {
+			atts[i].URL = fmt.Sprintf("data:%s;base64,<%d bytes>", du.MIME, du.Size())
+		}
+	}
+
+	req.Attachments = atts
+	return req
+}
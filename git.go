@@ -1,21 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-func Headers() map[string]string {
-	return map[string]string{
-		"Accept":               "application/vnd.github+json",
-		"Authorization":        fmt.Sprintf("Bearer %s", os.Getenv("GITHUB_KEY")),
-		"X-GitHub-Api-Version": GITHUB_API_VERSION,
-	}
-}
-
 const GITHUB_API_VERSION = "2022-11-28"
 
 type Repository struct {
@@ -41,70 +39,324 @@ type Commit struct {
 type PagesBuild struct {
 	Status string `json:"status"`
 	Commit string `json:"commit"`
+	Error  struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type Deployment struct {
+	ID  uint   `json:"id"`
+	SHA string `json:"sha"`
+}
+
+type DeploymentStatus struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
 }
 
+// githubPagesWorkflow deploys the repo root to Pages with GitHub Actions,
+// for PagesBuildType "workflow". %s is the branch.
+const githubPagesWorkflow = `name: pages
+on:
+  push:
+    branches: [%s]
+  workflow_dispatch:
+permissions:
+  contents: read
+  pages: write
+  id-token: write
+concurrency:
+  group: pages
+  cancel-in-progress: false
+jobs:
+  deploy:
+    environment:
+      name: github-pages
+      url: ${{ steps.deployment.outputs.page_url }}
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@v4
+        with:
+          lfs: true
+      - uses: actions/configure-pages@v5
+      - uses: actions/upload-pages-artifact@v3
+        with:
+          path: .
+      - id: deployment
+        uses: actions/deploy-pages@v4
+`
+
+const githubPagesWorkflowPath = ".github/workflows/pages.yml"
+
 type ContentResp struct {
 	SHA      string `json:"sha"`
 	Content  string `json:"content"`
 	Encoding string `json:"encoding"`
 }
 
-func InitGit() error {
-	repos, err := GetRepositories()
+// GitHub is the RepoHost backed by the GitHub REST API. Repos live under
+// Owner, which is either User's own account or an organization, and are
+// committed as User <Email>. Auth supplies the token for every call: a
+// personal access token, or short-lived installation tokens when running as
+// a GitHub App.
+type GitHub struct {
+	APIURL string
+	User   string
+	Owner  string
+	Branch string
+	Email  string
+	Auth   TokenSource
+	// PagesBuildType is how SetupPages publishes new sites: "legacy" builds
+	// from Branch, "workflow" deploys through GitHub Actions.
+	PagesBuildType string
+	Pages          PagesConfig
+
+	kinds *ownerKinds
+}
+
+// ownerKinds caches whether each owner is a "User" or an "Organization",
+// shared by every copy WithOwner makes.
+type ownerKinds struct {
+	mu    sync.Mutex
+	kinds map[string]string
+}
+
+func NewGitHubFromEnv() (*GitHub, error) {
+	g := &GitHub{
+		APIURL: EnvOr("GITHUB_API_URL", "https://api.github.com"),
+		User:   os.Getenv("GITHUB_USER"),
+		Owner:  EnvOr("GITHUB_OWNER", os.Getenv("GITHUB_USER")),
+		Branch: "main",
+		Email:  os.Getenv("GITHUB_EMAIL"),
+		Auth:   StaticToken(os.Getenv("GITHUB_KEY")),
+
+		PagesBuildType: EnvOr("GITHUB_PAGES_BUILD_TYPE", "legacy"),
+		Pages:          LoadPagesConfig(),
+
+		kinds: &ownerKinds{kinds: map[string]string{}},
+	}
+
+	app, err := NewGitHubAppFromEnv(g.APIURL, g.Owner)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if app != nil {
+		g.Auth = app.Installation(g.Owner)
 	}
 
-	if len(repos) == 0 {
-		return fmt.Errorf("git_check_failed")
+	// New jobs are held back while the API budget is nearly spent.
+	host := g.APIURL
+	if u, err := url.Parse(g.APIURL); err == nil {
+		host = u.Host
 	}
+	TrackRateLimit(githubRateLimit, host, EnvInt("GITHUB_RATE_LIMIT_RESERVE", 100))
 
-	return nil
+	return g, nil
+}
+
+func (g *GitHub) Headers(ctx context.Context) (map[string]string, error) {
+	token, err := g.Auth.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"Authorization":        fmt.Sprintf("Bearer %s", token),
+		"X-GitHub-Api-Version": GITHUB_API_VERSION,
+	}, nil
+}
+
+// githubRateLimit is the name GitHub's rate limit budgets are tracked under.
+const githubRateLimit = "github"
+
+// rateBudget is the budget key g's calls count against: each App
+// installation has a limit of its own, while a personal access token has one
+// limit for every owner.
+func (g *GitHub) rateBudget() string {
+	if _, ok := g.Auth.(OwnerTokenSource); ok {
+		return strings.ToLower(g.Owner)
+	}
+	return ""
+}
+
+// RateBudgets is the budget of g's token, plus the App's own for the calls
+// that fetch installation tokens.
+func (g *GitHub) RateBudgets() []string {
+	names := []string{RateBudgetName(githubRateLimit, g.rateBudget())}
+	if _, ok := g.Auth.(OwnerTokenSource); ok {
+		names = append(names, RateBudgetName(githubRateLimit, appRateBudget))
+	}
+	return names
 }
 
-func GetRepositories() ([]Repository, error) {
-	resp, err := HTTPGetClient(fmt.Sprintf("https://api.github.com/users/%s/repos", os.Getenv("GITHUB_USER")), Headers())
+func (g *GitHub) get(ctx context.Context, url string) ([]byte, error) {
+	ctx = withRateBudget(ctx, g.rateBudget())
+	headers, err := g.Headers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return HTTPGetClient(ctx, url, headers)
+}
 
+func (g *GitHub) send(ctx context.Context, url string, body any, method string) ([]byte, error) {
+	ctx = withRateBudget(ctx, g.rateBudget())
+	headers, err := g.Headers(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return HTTPPostPutClient(ctx, url, headers, body, method)
+}
 
-	var repos []Repository
+func (g *GitHub) delete(ctx context.Context, url string) error {
+	ctx = withRateBudget(ctx, g.rateBudget())
+	headers, err := g.Headers(ctx)
+	if err != nil {
+		return err
+	}
+	return HTTPDeleteClient(ctx, url, headers)
+}
 
-	if err := json.Unmarshal(resp, &repos); err != nil {
+// getAllPages is GetAllPages with the current credentials.
+func getAllPages[T any](ctx context.Context, g *GitHub, url string, limit int) ([]T, error) {
+	ctx = withRateBudget(ctx, g.rateBudget())
+	headers, err := g.Headers(ctx)
+	if err != nil {
 		return nil, err
 	}
+	return GetAllPages[T](ctx, url, headers, limit)
+}
 
-	return repos, nil
+// WithOwner returns a copy of the host that publishes under owner. Under a
+// GitHub App it authenticates as the app's installation on owner.
+func (g *GitHub) WithOwner(owner string) RepoHost {
+	c := *g
+	c.Owner = owner
+	if src, ok := g.Auth.(OwnerTokenSource); ok {
+		c.Auth = src.ForOwner(owner)
+	}
+	return &c
 }
 
-func CreateRepository(name string) error {
-	body := map[string]any{
-		"name":    name,
-		"private": false,
+// ownerKind looks up whether Owner is a user or an organization.
+func (g *GitHub) ownerKind(ctx context.Context) (string, error) {
+	g.kinds.mu.Lock()
+	kind, ok := g.kinds.kinds[g.Owner]
+	g.kinds.mu.Unlock()
+	if ok {
+		return kind, nil
 	}
 
-	_, err := HTTPPostPutClient("https://api.github.com/user/repos", Headers(), body, "POST")
+	resp, err := g.get(ctx, fmt.Sprintf("%s/users/%s", g.APIURL, g.Owner))
 	if err != nil {
+		return "", fmt.Errorf("get_owner(%s): %w", g.Owner, err)
+	}
+
+	var account struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(resp, &account); err != nil {
+		return "", err
+	}
+
+	g.kinds.mu.Lock()
+	g.kinds.kinds[g.Owner] = account.Type
+	g.kinds.mu.Unlock()
+
+	return account.Type, nil
+}
+
+func (g *GitHub) isOrg(ctx context.Context) (bool, error) {
+	kind, err := g.ownerKind(ctx)
+	return kind == "Organization", err
+}
+
+func (g *GitHub) repoURL(repo string, path string) string {
+	return fmt.Sprintf("%s/repos/%s/%s%s", g.APIURL, g.Owner, repo, path)
+}
+
+func (g *GitHub) committer() map[string]string {
+	return map[string]string{
+		"name":  g.User,
+		"email": g.Email,
+	}
+}
+
+// Check looks up Owner, which also tells whether repos are created under a
+// user or an organization. Repos for a user are created with POST
+// /user/repos, which always creates them for the token's own account, so a
+// user owner must be that account. A GitHub App can't call it at all, and can
+// only publish under organizations.
+func (g *GitHub) Check(ctx context.Context) error {
+	kind, err := g.ownerKind(ctx)
+	if err != nil {
+		return fmt.Errorf("git_check_failed: %w", err)
+	}
+	if kind != "User" {
+		return nil
+	}
+
+	if _, app := g.Auth.(OwnerTokenSource); app {
+		return fmt.Errorf("git_check_failed: github_app_user_owner:%s: a GitHub App can't create repos for a user account; use an organization or GITHUB_KEY", g.Owner)
+	}
+
+	resp, err := g.get(ctx, g.APIURL+"/user")
+	if err != nil {
+		return fmt.Errorf("git_check_failed: get_user: %w", err)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.Unmarshal(resp, &user); err != nil {
 		return err
 	}
 
+	if !strings.EqualFold(user.Login, g.Owner) {
+		return fmt.Errorf("git_check_failed: owner_not_token_user:%s: repos for a user are created under the token's account, %s; use that account, an organization, or a token of %s", g.Owner, user.Login, g.Owner)
+	}
 	return nil
 }
 
-func CreateFile(repo string, path string, content string, message string) error {
+func (g *GitHub) ListRepositories(ctx context.Context) ([]Repository, error) {
+	org, err := g.isOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := fmt.Sprintf("%s/users/%s/repos?per_page=100", g.APIURL, g.Owner)
+	if org {
+		list = fmt.Sprintf("%s/orgs/%s/repos?per_page=100", g.APIURL, g.Owner)
+	}
+
+	return getAllPages[Repository](ctx, g, list, 0)
+}
+
+func (g *GitHub) RepositoryExists(ctx context.Context, name string) (bool, error) {
+	_, err := g.get(ctx, g.repoURL(name, ""))
+	return exists(err)
+}
+
+// CreateRepository uses POST /orgs/{org}/repos for an organization owner.
+// For a user owner it uses POST /user/repos, so Owner must be the account
+// the token belongs to.
+func (g *GitHub) CreateRepository(ctx context.Context, name string) error {
 	body := map[string]any{
-		"message": message,
-		"committer": map[string]string{
-			"name":  os.Getenv("GITHUB_USER"),
-			"email": os.Getenv("GITHUB_EMAIL"),
-		},
-		"content": ToBase64(content),
+		"name":      name,
+		"private":   false,
+		"auto_init": true,
 	}
 
-	_, err := HTTPPostPutClient(fmt.Sprintf(
-		"https://api.github.com/repos/%s/%s/contents/%s", os.Getenv("GITHUB_USER"), repo, path), Headers(), body, "PUT")
+	org, err := g.isOrg(ctx)
+	if err != nil {
+		return err
+	}
 
+	create := g.APIURL + "/user/repos"
+	if org {
+		create = fmt.Sprintf("%s/orgs/%s/repos", g.APIURL, g.Owner)
+	}
+
+	_, err = g.send(ctx, create, body, "POST")
 	if err != nil {
 		return err
 	}
@@ -112,351 +364,625 @@ func CreateFile(repo string, path string, content string, message string) error
 	return nil
 }
 
-func CreateFileBytes(repo, path string, data []byte, message string) error {
-	body := map[string]any{
-		"message": message,
-		"committer": map[string]string{
-			"name":  os.Getenv("GITHUB_USER"),
-			"email": os.Getenv("GITHUB_EMAIL"),
-		},
-		"content": ToBase64Bytes(data),
+// GenerateRepository uses POST /repos/{template}/generate. GitHub copies
+// the files in the background, so it then waits for the default branch to
+// appear; a template whose default branch isn't Branch never gets there.
+func (g *GitHub) GenerateRepository(ctx context.Context, template, name string) error {
+	if _, err := g.send(ctx, fmt.Sprintf("%s/repos/%s/generate", g.APIURL, template), map[string]any{
+		"owner":                g.Owner,
+		"name":                 name,
+		"private":              false,
+		"include_all_branches": false,
+	}, "POST"); err != nil {
+		return fmt.Errorf("generate_repo(%s): %w", template, err)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, time.Minute,
+		fmt.Errorf("generate_repo_timeout: %s has no %s branch", name, g.Branch))
+	defer cancel()
+
+	for {
+		_, err := g.branchHead(ctx, name, g.Branch)
+		if err == nil {
+			return nil
+		}
+
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) || (httpErr.StatusCode != http.StatusNotFound && httpErr.StatusCode != http.StatusConflict) {
+			return err
+		}
+
+		if err := Sleep(ctx, 2*time.Second); err != nil {
+			return context.Cause(ctx)
+		}
 	}
+}
 
-	_, err := HTTPPostPutClient(
-		fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s",
-			os.Getenv("GITHUB_USER"), repo, path),
-		Headers(), body, "PUT",
-	)
+// TemplateFiles reads the template's tree at HEAD and fetches each blob.
+// Symlinks and submodules are left out.
+func (g *GitHub) TemplateFiles(ctx context.Context, template string) ([]FileChange, error) {
+	base := fmt.Sprintf("%s/repos/%s", g.APIURL, template)
+
+	resp, err := g.get(ctx, base+"/git/trees/HEAD?recursive=1")
+	if err != nil {
+		return nil, fmt.Errorf("get_template_tree(%s): %w", template, err)
+	}
+
+	var tree struct {
+		Tree      []treeEntry `json:"tree"`
+		Truncated bool        `json:"truncated"`
+	}
+	if err := json.Unmarshal(resp, &tree); err != nil {
+		return nil, err
+	}
+	if tree.Truncated {
+		return nil, fmt.Errorf("template_too_large:%s", template)
+	}
+
+	var files []FileChange
+	for _, e := range tree.Tree {
+		if e.Type != "blob" || e.Mode == "120000" {
+			continue
+		}
+
+		resp, err := g.get(ctx, base+"/git/blobs/"+e.SHA)
+		if err != nil {
+			return nil, fmt.Errorf("get_template_blob(%s): %w", e.Path, err)
+		}
+
+		var blob ContentResp
+		if err := json.Unmarshal(resp, &blob); err != nil {
+			return nil, err
+		}
+		data, err := FromBase64(blob.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, FileChange{Path: e.Path, Data: data})
+	}
+
+	return files, nil
+}
+
+func (g *GitHub) DeleteRepository(ctx context.Context, repo string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	return g.delete(ctx, g.repoURL(repo, ""))
+}
+
+func (g *GitHub) ArchiveRepository(ctx context.Context, repo, newName string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	_, err := g.send(ctx, g.repoURL(repo, ""), map[string]any{
+		"name":     newName,
+		"archived": true,
+	}, "PATCH")
+	return err
+}
+
+// UpdateMetadata sets the description and homepage, then replaces the
+// topics, which have an endpoint of their own.
+func (g *GitHub) UpdateMetadata(ctx context.Context, repo string, meta RepoMetadata) error {
+	if _, err := g.send(ctx, g.repoURL(repo, ""), map[string]any{
+		"description": meta.Description,
+		"homepage":    meta.Homepage,
+	}, "PATCH"); err != nil {
+		return err
+	}
+
+	_, err := g.send(ctx, g.repoURL(repo, "/topics"), map[string]any{"names": meta.Topics}, "PUT")
 	return err
 }
 
-func GetFileWithSHA(repo, path string) (sha string, decoded string, err error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", os.Getenv("GITHUB_USER"), repo, path)
-	resp, err := HTTPGetClient(url, Headers())
+func (g *GitHub) GetFile(ctx context.Context, repo, path string) (string, []byte, error) {
+	resp, err := g.get(ctx, g.repoURL(repo, "/contents/"+path))
 	if err != nil {
-		return "", "", err
+		return "", nil, wrapNotFound(err)
 	}
 
 	var cr ContentResp
 	if err := json.Unmarshal(resp, &cr); err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 	if cr.Encoding != "base64" {
-		return "", "", fmt.Errorf("unexpected encoding: %s", cr.Encoding)
+		return "", nil, fmt.Errorf("unexpected encoding: %s", cr.Encoding)
 	}
-	data, decErr := FromBase64(cr.Content) // implement using base64.StdEncoding.DecodeString
-	if decErr != nil {
-		return "", "", decErr
+	data, err := FromBase64(cr.Content)
+	if err != nil {
+		return "", nil, err
 	}
-	return cr.SHA, string(data), nil
+	return cr.SHA, data, nil
 }
 
-func UpdateFile(repo, path, newContent, message, sha string) error {
-	body := map[string]any{
-		"message": message,
-		"committer": map[string]string{
-			"name":  os.Getenv("GITHUB_USER"),
-			"email": os.Getenv("GITHUB_EMAIL"),
-		},
-		"content": ToBase64(newContent),
-		"sha":     sha,
-	}
-	_, err := HTTPPostPutClient(
-		fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s",
-			os.Getenv("GITHUB_USER"), repo, path),
-		Headers(), body, "PUT",
-	)
-	return err
+type gitRef struct {
+	Object struct {
+		SHA string `json:"sha"`
+	} `json:"object"`
 }
 
-func SetupPages(repo string) error {
-	_, err := HTTPPostPutClient(fmt.Sprintf("https://api.github.com/repos/%s/%s/pages", os.Getenv("GITHUB_USER"), repo), Headers(), map[string]any{
-		"source": map[string]string{
-			"branch": "main",
-			"path":   "/",
-		},
-	}, "POST")
+type gitCommit struct {
+	SHA  string `json:"sha"`
+	Tree struct {
+		SHA string `json:"sha"`
+	} `json:"tree"`
+}
+
+type gitObject struct {
+	SHA string `json:"sha"`
+}
+
+type treeEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+}
 
+// postJSON POSTs body to a repo endpoint and decodes the response into out.
+func (g *GitHub) postJSON(ctx context.Context, repo, path string, body any, out any) error {
+	resp, err := g.send(ctx, g.repoURL(repo, path), body, "POST")
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return json.Unmarshal(resp, out)
 }
 
-func SetupRepo(repo string) error {
-	if err := CreateFile(
-		repo,
-		"LICENSE",
-		CreateLicense(fmt.Sprintf("%s <%s>",
-			os.Getenv("GITHUB_NAME"),
-			os.Getenv("GITHUB_EMAIL"))),
-		"init: add license"); err != nil {
-		return err
+// Commit builds the commit with the Git Data API: a blob per file, one tree
+// on top of the branch head's tree, one commit, then a fast-forward of the
+// branch ref. Nothing is visible on the branch until the ref moves, so a
+// failure part way leaves the repo as it was.
+func (g *GitHub) Commit(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	head, err := g.branchHead(ctx, repo, g.Branch)
+	if err != nil {
+		return "", err
 	}
 
-	if err := SetupPages(repo); err != nil {
-		return err
+	sha, err := g.createCommit(ctx, repo, message, files, head.Tree.SHA, []string{head.SHA})
+	if err != nil {
+		return "", err
 	}
 
-	return nil
-}
+	if err := g.updateRef(ctx, repo, g.Branch, sha, false); err != nil {
+		return "", err
+	}
 
-func DeleteRepository(repo string) error {
-	return HTTPDeleteClient(fmt.Sprintf(
-		"https://api.github.com/repos/%s/%s", os.Getenv("GITHUB_USER"), repo), Headers())
+	return sha, nil
 }
 
-func GetLastCommitHash(repo string) (string, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/commits?per_page=1", os.Getenv("GITHUB_USER"), repo)
-	resp, err := HTTPGetClient(url, Headers())
+// branchHead returns the commit branch points at.
+func (g *GitHub) branchHead(ctx context.Context, repo, branch string) (gitCommit, error) {
+	resp, err := g.get(ctx, g.repoURL(repo, "/git/ref/heads/"+branch))
 	if err != nil {
+		return gitCommit{}, fmt.Errorf("get_ref: %w", err)
+	}
+	var ref gitRef
+	if err := json.Unmarshal(resp, &ref); err != nil {
+		return gitCommit{}, err
+	}
+
+	resp, err = g.get(ctx, g.repoURL(repo, "/git/commits/"+ref.Object.SHA))
+	if err != nil {
+		return gitCommit{}, fmt.Errorf("get_commit: %w", err)
+	}
+	var head gitCommit
+	if err := json.Unmarshal(resp, &head); err != nil {
+		return gitCommit{}, err
+	}
+
+	return head, nil
+}
+
+// ResetBranch points the branch at a new root commit holding only files.
+func (g *GitHub) ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	if err := requireManaged(ctx, g, repo); err != nil {
 		return "", err
 	}
 
-	var commits []Commit
-	if err := json.Unmarshal(resp, &commits); err != nil {
+	sha, err := g.createCommit(ctx, repo, message, files, "", []string{})
+	if err != nil {
 		return "", err
 	}
 
-	if len(commits) == 0 {
-		return "", fmt.Errorf("no commits found")
+	if err := g.updateRef(ctx, repo, g.Branch, sha, true); err != nil {
+		return "", err
 	}
 
-	return commits[0].SHA, nil
+	return sha, nil
 }
 
-func PagesBuildComplete(repo string, lastHash string) error {
-	for i := 0; i < 24; i++ {
-		time.Sleep(5 * time.Second)
-		resp, err := HTTPGetClient(fmt.Sprintf("https://api.github.com/repos/%s/%s/pages/builds", os.Getenv("GITHUB_USER"), repo), Headers())
-		if err != nil {
-			return err
+// createCommit writes a blob per file and a tree on top of baseTree (none
+// for an empty tree), then a commit of it with the given parents.
+func (g *GitHub) createCommit(ctx context.Context, repo, message string, files []FileChange, baseTree string, parents []string) (string, error) {
+	entries := make([]treeEntry, 0, len(files))
+	for _, f := range files {
+		var blob gitObject
+		if err := g.postJSON(ctx, repo, "/git/blobs", map[string]string{
+			"content":  ToBase64Bytes(f.Data),
+			"encoding": "base64",
+		}, &blob); err != nil {
+			return "", fmt.Errorf("create_blob(%s): %w", f.Path, err)
 		}
 
-		var builds []PagesBuild
-		if err := json.Unmarshal(resp, &builds); err != nil {
-			return err
-		}
+		entries = append(entries, treeEntry{Path: f.Path, Mode: "100644", Type: "blob", SHA: blob.SHA})
+	}
 
-		if len(builds) == 0 {
-			continue
-		}
+	treeBody := map[string]any{"tree": entries}
+	if baseTree != "" {
+		treeBody["base_tree"] = baseTree
+	}
 
-		latest := builds[0]
-		if latest.Commit == lastHash && latest.Status == "built" {
-			return nil
-		}
+	var tree gitObject
+	if err := g.postJSON(ctx, repo, "/git/trees", treeBody, &tree); err != nil {
+		return "", fmt.Errorf("create_tree: %w", err)
+	}
+
+	var commit gitObject
+	if err := g.postJSON(ctx, repo, "/git/commits", map[string]any{
+		"message":   message,
+		"tree":      tree.SHA,
+		"parents":   parents,
+		"author":    g.committer(),
+		"committer": g.committer(),
+	}, &commit); err != nil {
+		return "", fmt.Errorf("create_commit: %w", err)
 	}
 
-	return fmt.Errorf("pages_build_timeout")
+	return commit.SHA, nil
+}
+
+// updateRef moves branch to sha; without force it must be a fast-forward.
+func (g *GitHub) updateRef(ctx context.Context, repo, branch, sha string, force bool) error {
+	if _, err := g.send(ctx, g.repoURL(repo, "/git/refs/heads/"+branch), map[string]any{
+		"sha":   sha,
+		"force": force,
+	}, "PATCH"); err != nil {
+		return fmt.Errorf("update_ref: %w", err)
+	}
+	return nil
 }
 
-func Round1(req UserRequest) error {
-	err := InitGit()
+// CommitBranch creates branch at the new commit, or force-moves it there if
+// an earlier attempt already created it.
+func (g *GitHub) CommitBranch(ctx context.Context, repo, branch, message string, files []FileChange) (string, error) {
+	head, err := g.branchHead(ctx, repo, g.Branch)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	sha, err := g.createCommit(ctx, repo, message, files, head.Tree.SHA, []string{head.SHA})
+	if err != nil {
+		return "", err
 	}
 
-	name := req.Task
+	_, err = g.send(ctx, g.repoURL(repo, "/git/refs"), map[string]string{
+		"ref": "refs/heads/" + branch,
+		"sha": sha,
+	}, "POST")
 
-	repos, err := GetRepositories()
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnprocessableEntity {
+		err = g.updateRef(ctx, repo, branch, sha, true)
+	}
 	if err != nil {
-		return err
+		return "", fmt.Errorf("create_ref(%s): %w", branch, err)
 	}
 
-	hasRepo := false
+	return sha, nil
+}
 
-	for _, repo := range repos {
-		if repo.Name == name {
-			hasRepo = true
-			break
-		}
+func (g *GitHub) OpenPullRequest(ctx context.Context, repo, branch, title, body string) (PullRequest, error) {
+	open, err := getAllPages[PullRequest](ctx, g,
+		g.repoURL(repo, "/pulls?state=open&head="+url.QueryEscape(g.Owner+":"+branch)), 1)
+	if err != nil {
+		return PullRequest{}, err
+	}
+	if len(open) > 0 {
+		open[0].Branch = branch
+		return open[0], nil
 	}
 
-	if hasRepo {
-		if err := DeleteRepository(name); err != nil {
-			return err
-		}
+	var pr PullRequest
+	if err := g.postJSON(ctx, repo, "/pulls", map[string]string{
+		"title": title,
+		"head":  branch,
+		"base":  g.Branch,
+		"body":  body,
+	}, &pr); err != nil {
+		return PullRequest{}, fmt.Errorf("create_pull(%s): %w", branch, err)
 	}
 
-	if err := CreateRepository(name); err != nil {
-		return err
+	pr.Branch = branch
+	return pr, nil
+}
+
+func (g *GitHub) MergePullRequest(ctx context.Context, repo string, pr PullRequest, message string) (string, error) {
+	resp, err := g.send(ctx, g.repoURL(repo, fmt.Sprintf("/pulls/%d/merge", pr.Number)), map[string]string{
+		"merge_method": "merge",
+		"commit_title": message,
+	}, "PUT")
+	if err != nil {
+		return "", fmt.Errorf("merge_pull(%d): %w", pr.Number, err)
 	}
 
-	if err := SetupRepo(name); err != nil {
-		return err
+	var merge struct {
+		SHA    string `json:"sha"`
+		Merged bool   `json:"merged"`
+	}
+	if err := json.Unmarshal(resp, &merge); err != nil {
+		return "", err
+	}
+	if !merge.Merged {
+		return "", fmt.Errorf("merge_pull(%d): not merged", pr.Number)
 	}
 
-	vr := VibeRequest{
-		Prompt:       req.Brief,
-		Checks:       StringArrToString(req.Checks),
-		Attachements: []VibeAttachement{},
+	if err := g.delete(ctx, g.repoURL(repo, "/git/refs/heads/"+pr.Branch)); err != nil {
+		log.Printf("delete branch %s of %s: %v", pr.Branch, repo, err)
 	}
 
-	for _, att := range req.Attachments {
-		du, err := DecodeDataURL(att.URL)
-		if err != nil {
-			return fmt.Errorf("decode_data_url(%s): %w", att.Name, err)
-		}
+	return merge.SHA, nil
+}
 
-		dst := fmt.Sprintf("%s-%s", GenerateUUID(), att.Name)
+// CreateRelease writes an annotated tag object and points refs/tags at it,
+// force-moving a tag left by an earlier attempt or an earlier repo of the
+// same name. The release for the tag is then created or updated.
+func (g *GitHub) CreateRelease(ctx context.Context, repo string, rel Release) error {
+	var tag gitObject
+	if err := g.postJSON(ctx, repo, "/git/tags", map[string]any{
+		"tag":     rel.Tag,
+		"message": rel.Message(),
+		"object":  rel.SHA,
+		"type":    "commit",
+		"tagger":  g.committer(),
+	}, &tag); err != nil {
+		return fmt.Errorf("create_tag(%s): %w", rel.Tag, err)
+	}
+
+	_, err := g.send(ctx, g.repoURL(repo, "/git/refs"), map[string]string{
+		"ref": "refs/tags/" + rel.Tag,
+		"sha": tag.SHA,
+	}, "POST")
 
-		if err := CreateFileBytes(name, dst, du.Data, "feat: add attachment "+att.Name); err != nil {
-			return fmt.Errorf("create_file_bytes(%s): %w", dst, err)
-		}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnprocessableEntity {
+		_, err = g.send(ctx, g.repoURL(repo, "/git/refs/tags/"+rel.Tag), map[string]any{
+			"sha":   tag.SHA,
+			"force": true,
+		}, "PATCH")
+	}
+	if err != nil {
+		return fmt.Errorf("create_ref(%s): %w", rel.Tag, err)
+	}
 
-		vr.Attachements = append(vr.Attachements, VibeAttachement{
-			Filename: att.Name,
-			URL:      fmt.Sprintf("./%s", dst),
-		})
+	body := map[string]any{
+		"tag_name": rel.Tag,
+		"name":     rel.Name,
+		"body":     rel.Notes,
 	}
 
-	vibed, err := GenerateFrontend(vr)
+	resp, err := g.get(ctx, g.repoURL(repo, "/releases/tags/"+url.PathEscape(rel.Tag)))
+	found, err := exists(err)
 	if err != nil {
 		return err
 	}
 
-	for _, file := range *vibed {
-		if err := CreateFile(name,
-			file.Filename,
-			file.Content,
-			fmt.Sprintf("feat: add %s", file.Filename)); err != nil {
+	if found {
+		var existing struct {
+			ID uint `json:"id"`
+		}
+		if err := json.Unmarshal(resp, &existing); err != nil {
 			return err
 		}
+		_, err = g.send(ctx, g.repoURL(repo, fmt.Sprintf("/releases/%d", existing.ID)), body, "PATCH")
+	} else {
+		_, err = g.send(ctx, g.repoURL(repo, "/releases"), body, "POST")
+	}
+	if err != nil {
+		return fmt.Errorf("create_release(%s): %w", rel.Tag, err)
 	}
 
-	lastHash, err := GetLastCommitHash(name)
+	return nil
+}
+
+func (g *GitHub) LastCommit(ctx context.Context, repo string) (string, error) {
+	commits, err := getAllPages[Commit](ctx, g, g.repoURL(repo, "/commits?per_page=1"), 1)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err := PagesBuildComplete(name, lastHash); err != nil {
-		log.Printf("Pages build did not complete: %v", err)
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no commits found")
 	}
 
-	lastHash, err = GetLastCommitHash(name)
-	if err != nil {
-		return err
+	return commits[0].SHA, nil
+}
+
+// SetupPages enables Pages on the branch. With the "workflow" build type it
+// first commits the Actions workflow that deploys the site, which needs a
+// token allowed to write workflows. A repo that already has a site, e.g. one
+// reset for a new round 1, answers 409; its site is switched to the
+// configured build type and branch instead.
+func (g *GitHub) SetupPages(ctx context.Context, repo string) error {
+	body := map[string]any{
+		"source": map[string]string{
+			"branch": g.Branch,
+			"path":   "/",
+		},
 	}
 
-	evalReq := EvaluatorRequest{
-		Email:     req.Email,
-		Task:      req.Task,
-		Round:     1,
-		Nonce:     req.Nonce,
-		RepoURL:   fmt.Sprintf("https://github.com/%s/%s", os.Getenv("GITHUB_USER"), name),
-		CommitSHA: lastHash,
-		PagesURL:  fmt.Sprintf("https://%s.github.io/%s/", os.Getenv("GITHUB_USER"), name),
+	if g.PagesBuildType == "workflow" {
+		if _, _, err := g.GetFile(ctx, repo, githubPagesWorkflowPath); errors.Is(err, ErrNotFound) {
+			if _, err := g.Commit(ctx, repo, "ci: deploy Pages with GitHub Actions", []FileChange{{
+				Path: githubPagesWorkflowPath,
+				Data: []byte(fmt.Sprintf(githubPagesWorkflow, g.Branch)),
+			}}); err != nil {
+				return fmt.Errorf("commit_pages_workflow: %w", err)
+			}
+		} else if err != nil {
+			return err
+		}
+
+		body["build_type"] = "workflow"
 	}
 
-	if err := SatisfyEvaluator(evalReq, req.EvaluationURL); err != nil {
+	_, err := g.send(ctx, g.repoURL(repo, "/pages"), body, "POST")
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		body["build_type"] = "legacy"
+		if g.PagesBuildType == "workflow" {
+			body["build_type"] = "workflow"
+		}
+		if _, err := g.send(ctx, g.repoURL(repo, "/pages"), body, "PUT"); err != nil {
+			return fmt.Errorf("update_pages: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func Round2(req UserRequest) error {
-	// Ensure repo exists
-	name := req.Task
+// WaitForPages waits for the site to be published from commit sha, checking
+// whenever a page_build or deployment_status webhook arrives for the repo
+// and every Pages.Interval otherwise. Sites built from a branch are tracked
+// through their Pages builds, Actions-deployed ones through the
+// github-pages deployment of the commit.
+func (g *GitHub) WaitForPages(ctx context.Context, repo string, sha string) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, g.Pages.Timeout, errPagesTimeout)
+	defer cancel()
 
-	// Load current bundle (and SHAs)
-	readmeSHA, readmeContent, err := GetFileWithSHA(name, "README.md")
-	if err != nil {
-		return fmt.Errorf("get README.md: %w", err)
-	}
-	indexSHA, indexContent, err := GetFileWithSHA(name, "index.html")
+	events, stop := PagesEvents.Subscribe(g.Owner + "/" + repo)
+	defer stop()
+
+	resp, err := g.get(ctx, g.repoURL(repo, "/pages"))
 	if err != nil {
-		return fmt.Errorf("get index.html: %w", err)
+		return fmt.Errorf("get_pages: %w", err)
 	}
-
-	existing := []VibeResponse{
-		{Type: "markdown", Filename: "README.md", Content: readmeContent},
-		{Type: "html", Filename: "index.html", Content: indexContent},
+	var site struct {
+		BuildType string `json:"build_type"`
 	}
-
-	// Build VR (with attachments written to repo first, like Round1)
-	vr := VibeRequest{
-		Prompt:       req.Brief,
-		Checks:       StringArrToString(req.Checks),
-		Attachements: []VibeAttachement{},
+	if err := json.Unmarshal(resp, &site); err != nil {
+		return err
 	}
 
-	for _, att := range req.Attachments {
-		du, err := DecodeDataURL(att.URL)
-		if err != nil {
-			return fmt.Errorf("decode_data_url(%s): %w", att.Name, err)
+	for {
+		var done bool
+		if site.BuildType == "workflow" {
+			done, err = g.deploymentDone(ctx, repo, sha)
+		} else {
+			done, err = g.pagesBuildDone(ctx, repo, sha)
 		}
-		dst := fmt.Sprintf("%s-%s", GenerateUUID(), att.Name)
-		if err := CreateFileBytes(name, dst, du.Data, "feat: add attachment "+att.Name); err != nil {
-			return fmt.Errorf("create_file_bytes(%s): %w", dst, err)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err != nil || done {
+			return err
+		}
+
+		if err := waitPagesEvent(ctx, events, g.Pages.Interval); err != nil {
+			return err
 		}
-		vr.Attachements = append(vr.Attachements, VibeAttachement{
-			Filename: att.Name,
-			URL:      "./" + dst,
-		})
 	}
+}
 
-	// Ask the model to modify based on the current files
-	modified, err := ModifyFrontend(vr, existing)
+// pagesBuildDone looks for the build of sha among the latest few; a newer
+// push may already have queued another build ahead of it.
+func (g *GitHub) pagesBuildDone(ctx context.Context, repo, sha string) (bool, error) {
+	builds, err := getAllPages[PagesBuild](ctx, g, g.repoURL(repo, "/pages/builds?per_page=10"), 10)
 	if err != nil {
-		return err
+		return false, err
 	}
-	files := *modified
 
-	// Validate before committing
-	if verrs := ValidateVibeBundle(files); len(verrs) > 0 {
-		for _, e := range verrs {
-			log.Printf("bundle validation error: %v", e)
+	for _, b := range builds {
+		if b.Commit != sha {
+			continue
 		}
-		return fmt.Errorf("bundle_validation_failed")
-	}
 
-	// Update files with SHAs
-	shaMap := map[string]string{
-		"README.md":  readmeSHA,
-		"index.html": indexSHA,
-	}
-	for _, f := range files {
-		oldSHA, ok := shaMap[f.Filename]
-		if !ok {
-			return fmt.Errorf("unexpected filename in round2: %s", f.Filename)
-		}
-		if err := UpdateFile(name, f.Filename, f.Content, fmt.Sprintf("chore: update %s for round 2", f.Filename), oldSHA); err != nil {
-			return err
+		switch b.Status {
+		case "built":
+			return true, nil
+		case "errored":
+			return false, fmt.Errorf("pages_build_errored: %s", b.Error.Message)
 		}
+		return false, nil
 	}
 
-	// Notify evaluator
-	lastHash, err := GetLastCommitHash(name)
-	if err != nil {
-		return err
+	return false, nil
+}
+
+// deploymentDone checks the latest status of the github-pages deployment of
+// sha. An inactive deployment has been superseded by a newer one, which
+// VerifyPages can tell apart from ours.
+func (g *GitHub) deploymentDone(ctx context.Context, repo, sha string) (bool, error) {
+	deployments, err := getAllPages[Deployment](ctx, g,
+		g.repoURL(repo, "/deployments?environment=github-pages&sha="+url.QueryEscape(sha)), 1)
+	if err != nil || len(deployments) == 0 {
+		return false, err
 	}
 
-	// Optional: wait for Pages build again
-	if err := PagesBuildComplete(name, lastHash); err != nil {
-		log.Printf("Pages build did not complete (round2): %v", err)
+	statuses, err := getAllPages[DeploymentStatus](ctx, g,
+		g.repoURL(repo, fmt.Sprintf("/deployments/%d/statuses?per_page=1", deployments[0].ID)), 1)
+	if err != nil || len(statuses) == 0 {
+		return false, err
 	}
 
-	lastHash, err = GetLastCommitHash(name)
+	switch st := statuses[0]; st.State {
+	case "success", "inactive":
+		return true, nil
+	case "error", "failure":
+		return false, fmt.Errorf("pages_deployment_%s: %s", st.State, st.Description)
+	}
+	return false, nil
+}
+
+// LFSEndpoint authenticates as x-access-token with the API token, which
+// works for personal access tokens and installation tokens alike.
+func (g *GitHub) LFSEndpoint(ctx context.Context, repo string) (string, map[string]string, error) {
+	token, err := g.Auth.Token(ctx)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
+	return g.RepoURL(repo) + ".git/info/lfs", lfsBasicAuth("x-access-token", token), nil
+}
 
-	evalReq := EvaluatorRequest{
-		Email:     req.Email,
-		Task:      req.Task,
-		Round:     2,
-		Nonce:     req.Nonce,
-		RepoURL:   fmt.Sprintf("https://github.com/%s/%s", os.Getenv("GITHUB_USER"), name),
-		CommitSHA: lastHash,
-		PagesURL:  fmt.Sprintf("https://%s.github.io/%s/", os.Getenv("GITHUB_USER"), name),
+// PagesResolveLFS holds for sites deployed by an Actions workflow, whose
+// checkout fetches LFS objects. Branch-built sites serve the pointers. The
+// site itself is asked, as it may have been set up with another build type
+// than the one configured now; a repo without a site gets no pointers.
+func (g *GitHub) PagesResolveLFS(ctx context.Context, repo string) (bool, error) {
+	resp, err := g.get(ctx, g.repoURL(repo, "/pages"))
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get_pages: %w", err)
 	}
 
-	if err := SatisfyEvaluator(evalReq, req.EvaluationURL); err != nil {
-		return err
+	var site struct {
+		BuildType string `json:"build_type"`
 	}
+	if err := json.Unmarshal(resp, &site); err != nil {
+		return false, err
+	}
+	return site.BuildType == "workflow", nil
+}
 
-	return nil
+func (g *GitHub) RepoURL(repo string) string {
+	return fmt.Sprintf("https://github.com/%s/%s", g.Owner, repo)
+}
+
+// PagesURL is the project site of repo. Users and organizations both get
+// <owner>.github.io, always lowercase; a repo of that name is the owner's
+// root site.
+func (g *GitHub) PagesURL(repo string) string {
+	domain := strings.ToLower(g.Owner) + ".github.io"
+	if strings.ToLower(repo) == domain {
+		return fmt.Sprintf("https://%s/", domain)
+	}
+	return fmt.Sprintf("https://%s/%s/", domain, repo)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGitHubCheckUserOwnerMustBeTokenUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			fmt.Fprint(w, `{"login":"Alice","type":"User"}`)
+		case "/users/alice", "/users/bob":
+			fmt.Fprintf(w, `{"login":%q,"type":"User"}`, strings.TrimPrefix(r.URL.Path, "/users/"))
+		case "/users/example-org":
+			fmt.Fprint(w, `{"login":"example-org","type":"Organization"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	g := &GitHub{
+		APIURL: srv.URL,
+		Owner:  "alice",
+		Auth:   StaticToken("pat"),
+		kinds:  &ownerKinds{kinds: map[string]string{}},
+	}
+	ctx := context.Background()
+
+	if err := g.Check(ctx); err != nil {
+		t.Fatalf("Check(alice) = %v", err)
+	}
+	if err := g.WithOwner("example-org").Check(ctx); err != nil {
+		t.Fatalf("Check(example-org) = %v", err)
+	}
+
+	err := g.WithOwner("bob").Check(ctx)
+	if err == nil || !strings.Contains(err.Error(), "owner_not_token_user:bob") {
+		t.Fatalf("Check(bob) = %v, want owner_not_token_user", err)
+	}
+}
+
+func TestGitHubSetupPagesSwitchesExistingSiteToConfiguredBuildType(t *testing.T) {
+	var mu sync.Mutex
+	buildType := map[string]string{"legacy-site": "legacy"}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var repo string
+		if _, err := fmt.Sscanf(r.URL.Path, "/repos/alice/%s", &repo); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		repo, path, _ := strings.Cut(repo, "/")
+
+		switch {
+		case path == "contents/.github/workflows/pages.yml" && r.Method == http.MethodGet:
+			fmt.Fprint(w, `{"sha":"wf","encoding":"base64","content":""}`)
+		case path == "pages" && r.Method == http.MethodGet:
+			bt, ok := buildType[repo]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, `{"build_type":%q}`, bt)
+		case path == "pages" && r.Method == http.MethodPost:
+			if _, ok := buildType[repo]; ok {
+				http.Error(w, `{"message":"GitHub Pages is already enabled."}`, http.StatusConflict)
+				return
+			}
+			var body struct {
+				BuildType string `json:"build_type"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			buildType[repo] = cmp.Or(body.BuildType, "legacy")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+		case path == "pages" && r.Method == http.MethodPut:
+			var body struct {
+				BuildType string `json:"build_type"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			buildType[repo] = body.BuildType
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	g := &GitHub{
+		APIURL:         srv.URL,
+		Owner:          "alice",
+		Branch:         "main",
+		Auth:           StaticToken("pat"),
+		PagesBuildType: "workflow",
+		kinds:          &ownerKinds{kinds: map[string]string{}},
+	}
+	ctx := context.Background()
+
+	if lfs, err := g.PagesResolveLFS(ctx, "legacy-site"); err != nil || lfs {
+		t.Fatalf("PagesResolveLFS(legacy site) = %v, %v; want false", lfs, err)
+	}
+	if lfs, err := g.PagesResolveLFS(ctx, "no-site"); err != nil || lfs {
+		t.Fatalf("PagesResolveLFS(no site) = %v, %v; want false", lfs, err)
+	}
+
+	for _, repo := range []string{"legacy-site", "no-site"} {
+		if err := g.SetupPages(ctx, repo); err != nil {
+			t.Fatalf("SetupPages(%s) = %v", repo, err)
+		}
+		if lfs, err := g.PagesResolveLFS(ctx, repo); err != nil || !lfs {
+			t.Fatalf("PagesResolveLFS(%s) after SetupPages = %v, %v; want true", repo, lfs, err)
+		}
+	}
+}
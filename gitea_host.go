@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Gitea is the RepoHost for self-hosted Gitea and Forgejo instances, using
+// their /api/v1 REST API. Gitea has no Pages API of its own; sites are
+// expected to be served from Branch by a pages server (Codeberg-style), at
+// the URL PagesTemplate describes.
+type Gitea struct {
+	BaseURL string
+	User    string
+	Name    string
+	Email   string
+	Token   string
+	Branch  string
+	// PagesTemplate is the site URL with {owner}, {repo} and {host}
+	// placeholders, e.g. "https://{owner}.pages.{host}/{repo}/".
+	PagesTemplate string
+	// PagesLFS says the pages server serves LFS content; most, Codeberg's
+	// included, serve the pointers.
+	PagesLFS bool
+	Pages    PagesConfig
+}
+
+func NewGiteaFromEnv() (*Gitea, error) {
+	base := strings.TrimSuffix(os.Getenv("GITEA_URL"), "/")
+	if base == "" {
+		return nil, errors.New("gitea_url_missing")
+	}
+
+	return &Gitea{
+		BaseURL:       base,
+		User:          os.Getenv("GITEA_USER"),
+		Name:          EnvOr("GITHUB_NAME", os.Getenv("GITEA_USER")),
+		Email:         os.Getenv("GITHUB_EMAIL"),
+		Token:         os.Getenv("GITEA_TOKEN"),
+		Branch:        EnvOr("GITEA_BRANCH", "main"),
+		PagesTemplate: EnvOr("GITEA_PAGES_URL", "https://{owner}.pages.{host}/{repo}/"),
+		PagesLFS:      EnvBool("GITEA_PAGES_LFS", false),
+		Pages:         LoadPagesConfig(),
+	}, nil
+}
+
+func (g *Gitea) Headers() map[string]string {
+	return map[string]string{
+		"Accept":        "application/json",
+		"Authorization": "token " + g.Token,
+	}
+}
+
+func (g *Gitea) api(path string) string {
+	return g.BaseURL + "/api/v1" + path
+}
+
+func (g *Gitea) repoAPI(repo, path string) string {
+	return g.api(fmt.Sprintf("/repos/%s/%s%s", g.User, repo, path))
+}
+
+func (g *Gitea) identity() map[string]string {
+	return map[string]string{
+		"name":  g.Name,
+		"email": g.Email,
+	}
+}
+
+func (g *Gitea) Check(ctx context.Context) error {
+	if _, err := HTTPGetClient(ctx, g.api("/user"), g.Headers()); err != nil {
+		return fmt.Errorf("git_check_failed: %w", err)
+	}
+	return nil
+}
+
+func (g *Gitea) ListRepositories(ctx context.Context) ([]Repository, error) {
+	return GetAllPages[Repository](ctx, g.api(fmt.Sprintf("/users/%s/repos?limit=50", g.User)), g.Headers(), 0)
+}
+
+func (g *Gitea) RepositoryExists(ctx context.Context, name string) (bool, error) {
+	_, err := HTTPGetClient(ctx, g.repoAPI(name, ""), g.Headers())
+	return exists(err)
+}
+
+func (g *Gitea) CreateRepository(ctx context.Context, name string) error {
+	_, err := HTTPPostPutClient(ctx, g.api("/user/repos"), g.Headers(), map[string]any{
+		"name":           name,
+		"private":        false,
+		"auto_init":      true,
+		"readme":         "Default",
+		"default_branch": g.Branch,
+	}, "POST")
+	return err
+}
+
+func (g *Gitea) DeleteRepository(ctx context.Context, repo string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	return HTTPDeleteClient(ctx, g.repoAPI(repo, ""), g.Headers())
+}
+
+func (g *Gitea) ArchiveRepository(ctx context.Context, repo, newName string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	_, err := HTTPPostPutClient(ctx, g.repoAPI(repo, ""), g.Headers(), map[string]any{
+		"name":     newName,
+		"archived": true,
+	}, "PATCH")
+	return err
+}
+
+func (g *Gitea) UpdateMetadata(ctx context.Context, repo string, meta RepoMetadata) error {
+	if _, err := HTTPPostPutClient(ctx, g.repoAPI(repo, ""), g.Headers(), map[string]any{
+		"description": meta.Description,
+		"website":     meta.Homepage,
+	}, "PATCH"); err != nil {
+		return err
+	}
+
+	_, err := HTTPPostPutClient(ctx, g.repoAPI(repo, "/topics"), g.Headers(), map[string]any{
+		"topics": meta.Topics,
+	}, "PUT")
+	return err
+}
+
+func (g *Gitea) GetFile(ctx context.Context, repo, path string) (string, []byte, error) {
+	return g.getFile(ctx, repo, path, g.Branch)
+}
+
+func (g *Gitea) getFile(ctx context.Context, repo, path, ref string) (string, []byte, error) {
+	resp, err := HTTPGetClient(ctx, g.repoAPI(repo, "/contents/"+path+"?ref="+url.QueryEscape(ref)), g.Headers())
+	if err != nil {
+		return "", nil, wrapNotFound(err)
+	}
+
+	var cr ContentResp
+	if err := json.Unmarshal(resp, &cr); err != nil {
+		return "", nil, err
+	}
+	if cr.Encoding != "base64" {
+		return "", nil, fmt.Errorf("unexpected encoding: %s", cr.Encoding)
+	}
+	data, err := FromBase64(cr.Content)
+	if err != nil {
+		return "", nil, err
+	}
+	return cr.SHA, data, nil
+}
+
+// Commit uses the ChangeFiles endpoint (Gitea 1.20+, Forgejo), which writes
+// any number of files as a single commit.
+func (g *Gitea) Commit(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	ops, err := g.fileOps(ctx, repo, files)
+	if err != nil {
+		return "", err
+	}
+	return g.changeFiles(ctx, repo, message, ops)
+}
+
+// ResetBranch can't rewrite history through the API, so it commits files
+// along with the deletion of everything else on the branch.
+func (g *Gitea) ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return "", err
+	}
+
+	keep := map[string]bool{}
+	for _, f := range files {
+		keep[f.Path] = true
+	}
+
+	ops, err := g.fileOps(ctx, repo, files)
+	if err != nil {
+		return "", err
+	}
+
+	for page := 1; ; page++ {
+		resp, err := HTTPGetClient(ctx, g.repoAPI(repo, fmt.Sprintf("/git/trees/%s?recursive=true&page=%d", url.PathEscape(g.Branch), page)), g.Headers())
+		if err != nil {
+			return "", fmt.Errorf("get_tree: %w", err)
+		}
+
+		var tree struct {
+			Tree []struct {
+				Path string `json:"path"`
+				Type string `json:"type"`
+				SHA  string `json:"sha"`
+			} `json:"tree"`
+			Truncated bool `json:"truncated"`
+		}
+		if err := json.Unmarshal(resp, &tree); err != nil {
+			return "", err
+		}
+
+		for _, e := range tree.Tree {
+			if e.Type == "blob" && !keep[e.Path] {
+				ops = append(ops, map[string]string{"operation": "delete", "path": e.Path, "sha": e.SHA})
+			}
+		}
+
+		if !tree.Truncated || len(tree.Tree) == 0 {
+			break
+		}
+	}
+
+	return g.changeFiles(ctx, repo, message, ops)
+}
+
+// fileOps turns files into create/update operations. Existing files must be
+// named with their current blob SHA, so each path is looked up first.
+func (g *Gitea) fileOps(ctx context.Context, repo string, files []FileChange) ([]map[string]string, error) {
+	ops := make([]map[string]string, 0, len(files))
+	for _, f := range files {
+		op := map[string]string{
+			"operation": "create",
+			"path":      f.Path,
+			"content":   ToBase64Bytes(f.Data),
+		}
+
+		sha, _, err := g.GetFile(ctx, repo, f.Path)
+		switch {
+		case err == nil:
+			op["operation"] = "update"
+			op["sha"] = sha
+		case !errors.Is(err, ErrNotFound):
+			return nil, fmt.Errorf("get_file(%s): %w", f.Path, err)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// changeFiles applies ops to the branch as one commit and returns its SHA.
+func (g *Gitea) changeFiles(ctx context.Context, repo, message string, ops []map[string]string) (string, error) {
+	resp, err := HTTPPostPutClient(ctx, g.repoAPI(repo, "/contents"), g.Headers(), map[string]any{
+		"branch":    g.Branch,
+		"message":   message,
+		"author":    g.identity(),
+		"committer": g.identity(),
+		"files":     ops,
+	}, "POST")
+	if err != nil {
+		return "", err
+	}
+
+	var out struct {
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(resp, &out); err != nil {
+		return "", err
+	}
+
+	return out.Commit.SHA, nil
+}
+
+func (g *Gitea) LastCommit(ctx context.Context, repo string) (string, error) {
+	resp, err := HTTPGetClient(ctx, g.repoAPI(repo, "/branches/"+g.Branch), g.Headers())
+	if err != nil {
+		return "", err
+	}
+
+	var branch struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(resp, &branch); err != nil {
+		return "", err
+	}
+
+	if branch.Commit.ID == "" {
+		return "", fmt.Errorf("no commits found")
+	}
+
+	return branch.Commit.ID, nil
+}
+
+// CreateRelease deletes any release and tag of the same name before creating
+// them afresh: Gitea can't move a tag, nor delete one a release is on.
+func (g *Gitea) CreateRelease(ctx context.Context, repo string, rel Release) error {
+	tag := url.PathEscape(rel.Tag)
+
+	if err := ignoreNotFound(HTTPDeleteClient(ctx, g.repoAPI(repo, "/releases/tags/"+tag), g.Headers())); err != nil {
+		return fmt.Errorf("delete_release(%s): %w", rel.Tag, err)
+	}
+	if err := ignoreNotFound(HTTPDeleteClient(ctx, g.repoAPI(repo, "/tags/"+tag), g.Headers())); err != nil {
+		return fmt.Errorf("delete_tag(%s): %w", rel.Tag, err)
+	}
+
+	if _, err := HTTPPostPutClient(ctx, g.repoAPI(repo, "/tags"), g.Headers(), map[string]any{
+		"tag_name": rel.Tag,
+		"target":   rel.SHA,
+		"message":  rel.Message(),
+	}, "POST"); err != nil {
+		return fmt.Errorf("create_tag(%s): %w", rel.Tag, err)
+	}
+
+	if _, err := HTTPPostPutClient(ctx, g.repoAPI(repo, "/releases"), g.Headers(), map[string]any{
+		"tag_name": rel.Tag,
+		"name":     rel.Name,
+		"body":     rel.Notes,
+	}, "POST"); err != nil {
+		return fmt.Errorf("create_release(%s): %w", rel.Tag, err)
+	}
+
+	return nil
+}
+
+// SetupPages is a no-op: the pages server publishes Branch of every repo
+// without being asked.
+func (g *Gitea) SetupPages(ctx context.Context, repo string) error {
+	return nil
+}
+
+// WaitForPages polls the site every Pages.Interval until it serves the
+// index.html from commit sha, for up to Pages.Timeout. Without an index.html
+// at that commit, any successful response will do.
+func (g *Gitea) WaitForPages(ctx context.Context, repo string, sha string) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, g.Pages.Timeout, errPagesTimeout)
+	defer cancel()
+
+	_, want, err := g.getFile(ctx, repo, "index.html", sha)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	for {
+		if err := waitPagesEvent(ctx, nil, g.Pages.Interval); err != nil {
+			return err
+		}
+
+		got, err := HTTPGetClient(ctx, g.PagesURL(repo), nil)
+		if err != nil {
+			continue
+		}
+
+		if want == nil || bytes.Equal(bytes.TrimSpace(got), bytes.TrimSpace(want)) {
+			return nil
+		}
+	}
+}
+
+func (g *Gitea) LFSEndpoint(ctx context.Context, repo string) (string, map[string]string, error) {
+	return g.RepoURL(repo) + ".git/info/lfs", lfsBasicAuth(g.User, g.Token), nil
+}
+
+func (g *Gitea) PagesResolveLFS(ctx context.Context, repo string) (bool, error) {
+	return g.PagesLFS, nil
+}
+
+func (g *Gitea) RepoURL(repo string) string {
+	return fmt.Sprintf("%s/%s/%s", g.BaseURL, g.User, repo)
+}
+
+func (g *Gitea) PagesURL(repo string) string {
+	host := g.BaseURL
+	if u, err := url.Parse(g.BaseURL); err == nil {
+		host = u.Hostname()
+	}
+
+	return strings.NewReplacer(
+		"{owner}", strings.ToLower(g.User),
+		"{repo}", repo,
+		"{host}", host,
+	).Replace(g.PagesTemplate)
+}
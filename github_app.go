@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// TokenSource hands out the bearer token for GitHub API calls.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a long-lived personal access token.
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// OwnerTokenSource is a TokenSource whose tokens only act for one owner, so
+// publishing under another owner needs another source.
+type OwnerTokenSource interface {
+	TokenSource
+	ForOwner(owner string) TokenSource
+}
+
+// tokenRefreshMargin is how long before expiry an installation token is
+// replaced, so a token never runs out in the middle of a round.
+const tokenRefreshMargin = 5 * time.Minute
+
+// appRateBudget is the budget key of the calls made as the App itself, which
+// GitHub limits apart from its installations.
+const appRateBudget = "app"
+
+// GitHubApp authenticates as a GitHub App: it signs a short JWT with the
+// app's private key and exchanges it for installation access tokens, which
+// are cached until shortly before they expire. An installation, and so a
+// token, only acts for the one account the app is installed on; Installation
+// returns the token source for an owner.
+type GitHubApp struct {
+	APIURL string
+	AppID  int64
+	Key    *rsa.PrivateKey
+
+	// mu guards the caches only; lookups and token exchanges run outside it,
+	// one at a time per owner and per installation.
+	mu sync.Mutex
+	// installations maps lowercased owners to their installation IDs, filled
+	// from GITHUB_APP_INSTALLATION_ID and by lookups.
+	installations map[string]int64
+	tokens        map[int64]installationToken
+	lookups       singleflight.Group
+	exchanges     singleflight.Group
+}
+
+type installationToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewGitHubAppFromEnv returns nil if GITHUB_APP_ID isn't set, meaning a
+// personal access token is used instead. GITHUB_APP_INSTALLATION_ID, if set,
+// is taken as owner's installation; every other owner's is looked up.
+func NewGitHubAppFromEnv(apiURL, owner string) (*GitHubApp, error) {
+	if os.Getenv("GITHUB_APP_ID") == "" {
+		return nil, nil
+	}
+
+	appID, err := strconv.ParseInt(os.Getenv("GITHUB_APP_ID"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_ID: %w", err)
+	}
+
+	pemData := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if len(pemData) == 0 {
+		pemData, err = os.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"))
+		if err != nil {
+			return nil, fmt.Errorf("read GITHUB_APP_PRIVATE_KEY_PATH: %w", err)
+		}
+	}
+
+	key, err := parseRSAPrivateKey(pemData)
+	if err != nil {
+		return nil, err
+	}
+
+	app := NewGitHubApp(apiURL, appID, key)
+
+	if id := os.Getenv("GITHUB_APP_INSTALLATION_ID"); id != "" {
+		installationID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITHUB_APP_INSTALLATION_ID: %w", err)
+		}
+		app.installations[strings.ToLower(owner)] = installationID
+	}
+
+	return app, nil
+}
+
+func NewGitHubApp(apiURL string, appID int64, key *rsa.PrivateKey) *GitHubApp {
+	return &GitHubApp{
+		APIURL:        apiURL,
+		AppID:         appID,
+		Key:           key,
+		installations: map[string]int64{},
+		tokens:        map[int64]installationToken{},
+	}
+}
+
+// parseRSAPrivateKey accepts the PKCS#1 key GitHub generates as well as a
+// PKCS#8 conversion of it.
+func parseRSAPrivateKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("github_app_key: no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("github_app_key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("github_app_key: not an RSA key")
+	}
+	return key, nil
+}
+
+// JWT returns an RS256 token identifying the app, valid for nine minutes
+// (GitHub allows at most ten) and backdated a minute for clock drift.
+func (a *GitHubApp) JWT(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.AppID, 10),
+	})
+
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// AppInstallation is the token source for the app's installation on Owner.
+type AppInstallation struct {
+	App   *GitHubApp
+	Owner string
+}
+
+func (a *GitHubApp) Installation(owner string) AppInstallation {
+	return AppInstallation{App: a, Owner: owner}
+}
+
+func (i AppInstallation) Token(ctx context.Context) (string, error) {
+	return i.App.Token(ctx, i.Owner)
+}
+
+// ForOwner switches to owner's installation.
+func (i AppInstallation) ForOwner(owner string) TokenSource {
+	return i.App.Installation(owner)
+}
+
+func (a *GitHubApp) headers(now time.Time) (map[string]string, error) {
+	jwt, err := a.JWT(now)
+	if err != nil {
+		return nil, fmt.Errorf("github_app_jwt: %w", err)
+	}
+
+	return map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"Authorization":        "Bearer " + jwt,
+		"X-GitHub-Api-Version": GITHUB_API_VERSION,
+	}, nil
+}
+
+// shared runs fn once for every caller asking for key at the same time. fn
+// is not cancelled when one of the callers gives up, so the others still get
+// its result; each caller stops waiting when its own ctx is done.
+func shared[T any](ctx context.Context, group *singleflight.Group, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ch := group.DoChan(key, func() (any, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			var zero T
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	}
+}
+
+// installationID returns owner's installation, looking it up as an
+// organization and then as a user.
+func (a *GitHubApp) installationID(ctx context.Context, owner string) (int64, error) {
+	key := strings.ToLower(owner)
+
+	a.mu.Lock()
+	id, ok := a.installations[key]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	return shared(ctx, &a.lookups, key, func(ctx context.Context) (int64, error) {
+		return a.lookupInstallation(ctx, owner)
+	})
+}
+
+func (a *GitHubApp) lookupInstallation(ctx context.Context, owner string) (int64, error) {
+	headers, err := a.headers(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	ctx = withRateBudget(ctx, appRateBudget)
+	resp, err := HTTPGetClient(ctx, fmt.Sprintf("%s/orgs/%s/installation", a.APIURL, owner), headers)
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		resp, err = HTTPGetClient(ctx, fmt.Sprintf("%s/users/%s/installation", a.APIURL, owner), headers)
+	}
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		return 0, fmt.Errorf("github_app_not_installed:%s", owner)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("github_app_installation(%s): %w", owner, err)
+	}
+
+	var inst struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(resp, &inst); err != nil {
+		return 0, err
+	}
+
+	a.mu.Lock()
+	a.installations[strings.ToLower(owner)] = inst.ID
+	a.mu.Unlock()
+	return inst.ID, nil
+}
+
+// Token returns the cached token of owner's installation, exchanging a new
+// JWT for a fresh one when it is missing or about to expire.
+func (a *GitHubApp) Token(ctx context.Context, owner string) (string, error) {
+	id, err := a.installationID(ctx, owner)
+	if err != nil {
+		return "", err
+	}
+
+	if token, ok := a.cachedToken(id); ok {
+		return token, nil
+	}
+
+	return shared(ctx, &a.exchanges, strconv.FormatInt(id, 10), func(ctx context.Context) (string, error) {
+		// A caller that was just ahead of us may have refreshed it already.
+		if token, ok := a.cachedToken(id); ok {
+			return token, nil
+		}
+		return a.exchangeToken(ctx, id)
+	})
+}
+
+// cachedToken returns installation id's token unless it is missing or about
+// to expire.
+func (a *GitHubApp) cachedToken(id int64) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cached, ok := a.tokens[id]
+	if !ok || !time.Now().Add(tokenRefreshMargin).Before(cached.expires) {
+		return "", false
+	}
+	return cached.token, true
+}
+
+// exchangeToken trades a fresh JWT for a new token of installation id.
+func (a *GitHubApp) exchangeToken(ctx context.Context, id int64) (string, error) {
+	headers, err := a.headers(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := HTTPPostPutClient(withRateBudget(ctx, appRateBudget),
+		fmt.Sprintf("%s/app/installations/%d/access_tokens", a.APIURL, id), headers, nil, "POST")
+	if err != nil {
+		return "", fmt.Errorf("github_app_token: %w", err)
+	}
+
+	var out struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(resp, &out); err != nil {
+		return "", err
+	}
+	if out.Token == "" {
+		return "", errors.New("github_app_token: empty token in response")
+	}
+
+	a.mu.Lock()
+	a.tokens[id] = installationToken{token: out.Token, expires: out.ExpiresAt}
+	a.mu.Unlock()
+	return out.Token, nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAppAPI is the slice of the GitHub API an app talks to: installation
+// lookups and the token endpoint, which checks every JWT it is given.
+type fakeAppAPI struct {
+	t     *testing.T
+	key   *rsa.PublicKey
+	appID int64
+
+	mu sync.Mutex
+	// orgs and users map owners to their installation IDs.
+	orgs    map[string]int64
+	users   map[string]int64
+	lookups int
+	issued  map[int64]int
+	// lifetime is how long the tokens handed out are valid.
+	lifetime time.Duration
+	// hold keeps token requests for an installation waiting until its
+	// channel is closed.
+	hold map[int64]chan struct{}
+}
+
+func (f *fakeAppAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var held int64
+	if _, err := fmt.Sscanf(r.URL.Path, "/app/installations/%d/access_tokens", &held); err == nil {
+		f.mu.Lock()
+		ch := f.hold[held]
+		f.mu.Unlock()
+		if ch != nil {
+			<-ch
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.verifyJWT(r.Header.Get("Authorization")) {
+		http.Error(w, `{"message":"bad JWT"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var owner string
+	var id int64
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/installation"):
+		f.lookups++
+
+		var ok bool
+		if _, err := fmt.Sscanf(r.URL.Path, "/orgs/%s", &owner); err == nil {
+			id, ok = f.orgs[strings.TrimSuffix(owner, "/installation")]
+		} else if _, err := fmt.Sscanf(r.URL.Path, "/users/%s", &owner); err == nil {
+			id, ok = f.users[strings.TrimSuffix(owner, "/installation")]
+		}
+		if !ok {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int64{"id": id})
+
+	case r.Method == http.MethodPost:
+		if _, err := fmt.Sscanf(r.URL.Path, "/app/installations/%d/access_tokens", &id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		f.issued[id]++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":      fmt.Sprintf("inst-%d-%d", id, f.issued[id]),
+			"expires_at": time.Now().Add(f.lifetime).UTC().Format(time.RFC3339),
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verifyJWT checks the RS256 signature and that the claims name the app and
+// stay within GitHub's ten minute limit.
+func (f *fakeAppAPI) verifyJWT(auth string) bool {
+	jwt, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return false
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, sum[:], sig); err != nil {
+		f.t.Errorf("JWT signature: %v", err)
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return false
+	}
+
+	now := time.Now().Unix()
+	if claims.Iss != fmt.Sprint(f.appID) || claims.Iat > now || claims.Exp <= now || claims.Exp-claims.Iat > 600 {
+		f.t.Errorf("JWT claims: %+v", claims)
+		return false
+	}
+	return true
+}
+
+func (f *fakeAppAPI) tokensIssued(id int64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued[id]
+}
+
+func newFakeAppAPI(t *testing.T) (*fakeAppAPI, *rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeAppAPI{
+		t:        t,
+		key:      &key.PublicKey,
+		appID:    4242,
+		orgs:     map[string]int64{"example-org": 11, "other-org": 12},
+		users:    map[string]int64{"alice": 13},
+		issued:   map[int64]int{},
+		lifetime: time.Hour,
+		hold:     map[int64]chan struct{}{},
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, key, srv.URL
+}
+
+func TestGitHubAppCachesAndRefreshesTokens(t *testing.T) {
+	api, key, url := newFakeAppAPI(t)
+	app := NewGitHubApp(url, api.appID, key)
+	ctx := context.Background()
+
+	first, err := app.Token(ctx, "example-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := app.Token(ctx, "example-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "inst-11-1" || again != first || api.tokensIssued(11) != 1 {
+		t.Fatalf("tokens %q, %q after %d exchanges; want one cached token", first, again, api.tokensIssued(11))
+	}
+
+	// A token inside the refresh margin is replaced before it runs out.
+	api.mu.Lock()
+	api.lifetime = tokenRefreshMargin - time.Minute
+	api.mu.Unlock()
+
+	app.tokens[11] = installationToken{token: first, expires: time.Now().Add(tokenRefreshMargin - time.Second)}
+	refreshed, err := app.Token(ctx, "example-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed != "inst-11-2" {
+		t.Fatalf("token near expiry = %q, want a fresh one", refreshed)
+	}
+
+	// That one expires within the margin too, so it isn't reused.
+	if tok, err := app.Token(ctx, "example-org"); err != nil || tok != "inst-11-3" {
+		t.Fatalf("Token = %q, %v; want inst-11-3", tok, err)
+	}
+}
+
+func TestGitHubAppResolvesInstallationPerOwner(t *testing.T) {
+	api, key, url := newFakeAppAPI(t)
+	app := NewGitHubApp(url, api.appID, key)
+	ctx := context.Background()
+
+	for owner, want := range map[string]string{
+		"example-org": "inst-11-1",
+		"other-org":   "inst-12-1",
+		"alice":       "inst-13-1",
+	} {
+		if tok, err := app.Installation(owner).Token(ctx); err != nil || tok != want {
+			t.Fatalf("Token(%s) = %q, %v; want %q", owner, tok, err, want)
+		}
+	}
+
+	// alice is found on the second try, under /users.
+	lookups := api.lookups
+	if lookups != 4 {
+		t.Fatalf("%d installation lookups, want 4", lookups)
+	}
+	if _, err := app.Token(ctx, "Example-Org"); err != nil || api.lookups != lookups {
+		t.Fatalf("installation looked up again (%d lookups, err %v)", api.lookups, err)
+	}
+
+	if _, err := app.Token(ctx, "nobody"); err == nil || !strings.Contains(err.Error(), "github_app_not_installed:nobody") {
+		t.Fatalf("Token(nobody) = %v, want github_app_not_installed", err)
+	}
+}
+
+func TestGitHubAppSharesTokenRequestsPerInstallation(t *testing.T) {
+	api, key, url := newFakeAppAPI(t)
+	app := NewGitHubApp(url, api.appID, key)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	api.mu.Lock()
+	api.hold[11] = release
+	api.mu.Unlock()
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 8)
+	errs := make([]error, len(tokens))
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = app.Token(ctx, "example-org")
+		}()
+	}
+
+	// Another installation's token isn't stuck behind the held exchange.
+	done := make(chan error, 1)
+	go func() {
+		_, err := app.Token(ctx, "other-org")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Token(other-org) = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Token(other-org) waited for example-org's exchange")
+	}
+
+	// A caller that gives up stops waiting without failing the others.
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := app.Token(cancelled, "example-org"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Token with expired context = %v, want DeadlineExceeded", err)
+	}
+
+	close(release)
+	wg.Wait()
+	for i, tok := range tokens {
+		if errs[i] != nil || tok != "inst-11-1" {
+			t.Fatalf("Token = %q, %v; want inst-11-1", tok, errs[i])
+		}
+	}
+	if n := api.tokensIssued(11); n != 1 {
+		t.Fatalf("%d tokens issued for concurrent callers, want 1", n)
+	}
+	api.mu.Lock()
+	lookups := api.lookups
+	api.mu.Unlock()
+	if lookups != 2 {
+		t.Fatalf("%d installation lookups, want one per owner", lookups)
+	}
+}
+
+func TestGitHubAppFromEnvUsesInstallationForOwner(t *testing.T) {
+	api, key, url := newFakeAppAPI(t)
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	t.Setenv("GITHUB_APP_ID", fmt.Sprint(api.appID))
+	t.Setenv("GITHUB_APP_INSTALLATION_ID", "99")
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", string(keyPEM))
+
+	app, err := NewGitHubAppFromEnv(url, "example-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GitHub{APIURL: url, Owner: "example-org", Auth: app.Installation("example-org")}
+	if tok, err := g.Auth.Token(context.Background()); err != nil || tok != "inst-99-1" {
+		t.Fatalf("Token = %q, %v; want the configured installation", tok, err)
+	}
+
+	other := g.WithOwner("other-org").(*GitHub)
+	if tok, err := other.Auth.Token(context.Background()); err != nil || tok != "inst-12-1" {
+		t.Fatalf("WithOwner token = %q, %v; want other-org's installation", tok, err)
+	}
+	if api.lookups != 1 {
+		t.Fatalf("%d installation lookups, want 1", api.lookups)
+	}
+}
+
+func TestGitHubCheckRejectsAppWithUserOwner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/alice/installation":
+			json.NewEncoder(w).Encode(map[string]int64{"id": 13})
+		case r.URL.Path == "/app/installations/13/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token":"inst-13","expires_at":%q}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		case r.URL.Path == "/users/alice":
+			fmt.Fprint(w, `{"login":"alice","type":"User"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	app := NewGitHubApp(srv.URL, 1, key)
+	g := &GitHub{
+		APIURL: srv.URL,
+		Owner:  "alice",
+		Auth:   app.Installation("alice"),
+		kinds:  &ownerKinds{kinds: map[string]string{}},
+	}
+
+	err = g.Check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "github_app_user_owner:alice") {
+		t.Fatalf("Check = %v, want github_app_user_owner", err)
+	}
+}
+
+func TestGitHubTracksRateLimitPerInstallation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := time.Now().Add(time.Hour).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/orgs/rate-low/installation":
+			json.NewEncoder(w).Encode(map[string]int64{"id": 21})
+		case r.URL.Path == "/orgs/rate-high/installation":
+			json.NewEncoder(w).Encode(map[string]int64{"id": 22})
+		case strings.HasPrefix(r.URL.Path, "/app/installations/"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token":"inst","expires_at":%q}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		case strings.HasPrefix(r.URL.Path, "/users/"):
+			remaining := "4000"
+			if r.URL.Path == "/users/rate-low" {
+				remaining = "10"
+			}
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", remaining)
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset))
+			fmt.Fprintf(w, `{"login":%q,"type":"Organization"}`, strings.TrimPrefix(r.URL.Path, "/users/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	TrackRateLimit(githubRateLimit, host, 100)
+	t.Cleanup(func() {
+		rateMu.Lock()
+		delete(rateNames, host)
+		rateMu.Unlock()
+	})
+
+	g := &GitHub{
+		APIURL: srv.URL,
+		Owner:  "rate-low",
+		Auth:   NewGitHubApp(srv.URL, 1, key).Installation("rate-low"),
+		kinds:  &ownerKinds{kinds: map[string]string{}},
+	}
+	low := g.WithOwner("rate-low").(*GitHub)
+	high := g.WithOwner("rate-high").(*GitHub)
+
+	ctx := context.Background()
+	for _, h := range []*GitHub{low, high} {
+		if _, err := h.ownerKind(ctx); err != nil {
+			t.Fatalf("ownerKind(%s) = %v", h.Owner, err)
+		}
+	}
+
+	now := time.Now()
+	if until := RateLimitPause(now, low.RateBudgets()...); until.Unix() != reset {
+		t.Fatalf("rate-low paused until %v, want %v", until, time.Unix(reset, 0))
+	}
+	if until := RateLimitPause(now, high.RateBudgets()...); !until.IsZero() {
+		t.Fatalf("rate-high paused until %v by another installation's budget", until)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// gitlabPagesCI is the .gitlab-ci.yml added to every project: the site is
+// the repo root, published as-is from the default branch.
+const gitlabPagesCI = `pages:
+  stage: deploy
+  image: alpine:latest
+  script:
+    - mkdir .public
+    - cp -r ./* .public
+    - rm -rf public
+    - mv .public public
+  artifacts:
+    paths:
+      - public
+  rules:
+    - if: $CI_COMMIT_BRANCH == $CI_DEFAULT_BRANCH
+`
+
+// GitLab is the RepoHost for gitlab.com and self-managed GitLab, using the
+// v4 REST API. Sites are deployed by a Pages job in .gitlab-ci.yml, which
+// Commit adds to the first commit of every project.
+type GitLab struct {
+	BaseURL     string
+	User        string
+	Name        string
+	Email       string
+	Token       string
+	Branch      string
+	PagesDomain string
+	Pages       PagesConfig
+}
+
+func NewGitLabFromEnv() *GitLab {
+	return &GitLab{
+		BaseURL:     strings.TrimSuffix(EnvOr("GITLAB_URL", "https://gitlab.com"), "/"),
+		User:        os.Getenv("GITLAB_USER"),
+		Name:        EnvOr("GITHUB_NAME", os.Getenv("GITLAB_USER")),
+		Email:       os.Getenv("GITHUB_EMAIL"),
+		Token:       os.Getenv("GITLAB_TOKEN"),
+		Branch:      "main",
+		PagesDomain: EnvOr("GITLAB_PAGES_DOMAIN", "gitlab.io"),
+		Pages:       LoadPagesConfig(),
+	}
+}
+
+func (g *GitLab) Headers() map[string]string {
+	return map[string]string{
+		"Accept":        "application/json",
+		"PRIVATE-TOKEN": g.Token,
+	}
+}
+
+func (g *GitLab) api(path string) string {
+	return g.BaseURL + "/api/v4" + path
+}
+
+// projectAPI addresses a project by its URL-encoded "namespace/name" path.
+func (g *GitLab) projectAPI(repo, path string) string {
+	return g.api("/projects/" + url.PathEscape(g.User+"/"+repo) + path)
+}
+
+func (g *GitLab) Check(ctx context.Context) error {
+	if _, err := HTTPGetClient(ctx, g.api("/user"), g.Headers()); err != nil {
+		return fmt.Errorf("git_check_failed: %w", err)
+	}
+	return nil
+}
+
+type gitlabProject struct {
+	ID     uint   `json:"id"`
+	Path   string `json:"path"`
+	WebURL string `json:"web_url"`
+}
+
+func (g *GitLab) ListRepositories(ctx context.Context) ([]Repository, error) {
+	projects, err := GetAllPages[gitlabProject](ctx, g.api(fmt.Sprintf("/users/%s/projects?per_page=100", url.PathEscape(g.User))), g.Headers(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]Repository, 0, len(projects))
+	for _, p := range projects {
+		repos = append(repos, Repository{ID: p.ID, Name: p.Path, HTMLURL: p.WebURL})
+	}
+
+	return repos, nil
+}
+
+func (g *GitLab) RepositoryExists(ctx context.Context, name string) (bool, error) {
+	_, err := HTTPGetClient(ctx, g.projectAPI(name, ""), g.Headers())
+	return exists(err)
+}
+
+func (g *GitLab) CreateRepository(ctx context.Context, name string) error {
+	_, err := HTTPPostPutClient(ctx, g.api("/projects"), g.Headers(), map[string]any{
+		"name":                   name,
+		"path":                   name,
+		"visibility":             "public",
+		"initialize_with_readme": true,
+		"default_branch":         g.Branch,
+	}, "POST")
+	return err
+}
+
+func (g *GitLab) DeleteRepository(ctx context.Context, repo string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	return HTTPDeleteClient(ctx, g.projectAPI(repo, ""), g.Headers())
+}
+
+// ArchiveRepository renames the project and its path, then archives it
+// under the new path.
+func (g *GitLab) ArchiveRepository(ctx context.Context, repo, newName string) error {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return err
+	}
+	if _, err := HTTPPostPutClient(ctx, g.projectAPI(repo, ""), g.Headers(), map[string]any{
+		"name": newName,
+		"path": newName,
+	}, "PUT"); err != nil {
+		return err
+	}
+
+	_, err := HTTPPostPutClient(ctx, g.projectAPI(newName, "/archive"), g.Headers(), nil, "POST")
+	return err
+}
+
+// UpdateMetadata sets the description and topics. GitLab projects have no
+// homepage field; the Pages URL shows on the project's Pages settings.
+func (g *GitLab) UpdateMetadata(ctx context.Context, repo string, meta RepoMetadata) error {
+	_, err := HTTPPostPutClient(ctx, g.projectAPI(repo, ""), g.Headers(), map[string]any{
+		"description": meta.Description,
+		"topics":      meta.Topics,
+	}, "PUT")
+	return err
+}
+
+func (g *GitLab) GetFile(ctx context.Context, repo, path string) (string, []byte, error) {
+	resp, err := HTTPGetClient(ctx,
+		g.projectAPI(repo, "/repository/files/"+url.PathEscape(path)+"?ref="+url.QueryEscape(g.Branch)),
+		g.Headers())
+	if err != nil {
+		return "", nil, wrapNotFound(err)
+	}
+
+	var file struct {
+		BlobID   string `json:"blob_id"`
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(resp, &file); err != nil {
+		return "", nil, err
+	}
+	if file.Encoding != "base64" {
+		return "", nil, fmt.Errorf("unexpected encoding: %s", file.Encoding)
+	}
+	data, err := FromBase64(file.Content)
+	if err != nil {
+		return "", nil, err
+	}
+	return file.BlobID, data, nil
+}
+
+// Commit writes all files with a single call to the commits API. The Pages
+// job is added along with the first commit.
+func (g *GitLab) Commit(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	actions, err := g.fileActions(ctx, repo, files)
+	if err != nil {
+		return "", err
+	}
+	return g.commitActions(ctx, repo, message, actions)
+}
+
+// ResetBranch can't rewrite history through the API, so it commits files
+// along with the deletion of everything else on the branch except the Pages
+// job.
+func (g *GitLab) ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	if err := requireManaged(ctx, g, repo); err != nil {
+		return "", err
+	}
+
+	keep := map[string]bool{".gitlab-ci.yml": true}
+	for _, f := range files {
+		keep[f.Path] = true
+	}
+
+	actions, err := g.fileActions(ctx, repo, files)
+	if err != nil {
+		return "", err
+	}
+
+	type treeEntry struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+	}
+	tree, err := GetAllPages[treeEntry](ctx,
+		g.projectAPI(repo, "/repository/tree?recursive=true&per_page=100&ref="+url.QueryEscape(g.Branch)),
+		g.Headers(), 0)
+	if err != nil {
+		return "", fmt.Errorf("get_tree: %w", err)
+	}
+
+	for _, e := range tree {
+		if e.Type == "blob" && !keep[e.Path] {
+			actions = append(actions, map[string]string{"action": "delete", "file_path": e.Path})
+		}
+	}
+
+	return g.commitActions(ctx, repo, message, actions)
+}
+
+// fileActions turns files into commit actions, plus the Pages job if the
+// branch doesn't have it yet. GitLab needs to be told whether each file is
+// created or updated, so each path is looked up first.
+func (g *GitLab) fileActions(ctx context.Context, repo string, files []FileChange) ([]map[string]string, error) {
+	actions := make([]map[string]string, 0, len(files)+1)
+
+	if _, _, err := g.GetFile(ctx, repo, ".gitlab-ci.yml"); errors.Is(err, ErrNotFound) {
+		actions = append(actions, map[string]string{
+			"action":    "create",
+			"file_path": ".gitlab-ci.yml",
+			"content":   gitlabPagesCI,
+		})
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		action := "create"
+		if _, _, err := g.GetFile(ctx, repo, f.Path); err == nil {
+			action = "update"
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("get_file(%s): %w", f.Path, err)
+		}
+
+		actions = append(actions, map[string]string{
+			"action":    action,
+			"file_path": f.Path,
+			"content":   ToBase64Bytes(f.Data),
+			"encoding":  "base64",
+		})
+	}
+
+	return actions, nil
+}
+
+// commitActions applies actions to the branch as one commit and returns its
+// SHA.
+func (g *GitLab) commitActions(ctx context.Context, repo, message string, actions []map[string]string) (string, error) {
+	resp, err := HTTPPostPutClient(ctx, g.projectAPI(repo, "/repository/commits"), g.Headers(), map[string]any{
+		"branch":         g.Branch,
+		"commit_message": message,
+		"author_name":    g.Name,
+		"author_email":   g.Email,
+		"actions":        actions,
+	}, "POST")
+	if err != nil {
+		return "", err
+	}
+
+	var commit struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(resp, &commit); err != nil {
+		return "", err
+	}
+
+	return commit.ID, nil
+}
+
+func (g *GitLab) LastCommit(ctx context.Context, repo string) (string, error) {
+	resp, err := HTTPGetClient(ctx, g.projectAPI(repo, "/repository/branches/"+url.PathEscape(g.Branch)), g.Headers())
+	if err != nil {
+		return "", err
+	}
+
+	var branch struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(resp, &branch); err != nil {
+		return "", err
+	}
+
+	if branch.Commit.ID == "" {
+		return "", fmt.Errorf("no commits found")
+	}
+
+	return branch.Commit.ID, nil
+}
+
+// CreateRelease deletes any release and tag of the same name before creating
+// them afresh, since GitLab tags can't be moved.
+func (g *GitLab) CreateRelease(ctx context.Context, repo string, rel Release) error {
+	tag := url.PathEscape(rel.Tag)
+
+	if err := ignoreNotFound(HTTPDeleteClient(ctx, g.projectAPI(repo, "/releases/"+tag), g.Headers())); err != nil {
+		return fmt.Errorf("delete_release(%s): %w", rel.Tag, err)
+	}
+	if err := ignoreNotFound(HTTPDeleteClient(ctx, g.projectAPI(repo, "/repository/tags/"+tag), g.Headers())); err != nil {
+		return fmt.Errorf("delete_tag(%s): %w", rel.Tag, err)
+	}
+
+	if _, err := HTTPPostPutClient(ctx, g.projectAPI(repo, "/repository/tags"), g.Headers(), map[string]any{
+		"tag_name": rel.Tag,
+		"ref":      rel.SHA,
+		"message":  rel.Message(),
+	}, "POST"); err != nil {
+		return fmt.Errorf("create_tag(%s): %w", rel.Tag, err)
+	}
+
+	if _, err := HTTPPostPutClient(ctx, g.projectAPI(repo, "/releases"), g.Headers(), map[string]any{
+		"tag_name":    rel.Tag,
+		"name":        rel.Name,
+		"description": rel.Notes,
+	}, "POST"); err != nil {
+		return fmt.Errorf("create_release(%s): %w", rel.Tag, err)
+	}
+
+	return nil
+}
+
+// SetupPages makes the site public and turns off GitLab's unique Pages
+// domains, so the site lives at the predictable URL PagesURL reports.
+// Instances too old to have unique domains answer 404 to the second call.
+func (g *GitLab) SetupPages(ctx context.Context, repo string) error {
+	if _, err := HTTPPostPutClient(ctx, g.projectAPI(repo, ""), g.Headers(), map[string]any{
+		"pages_access_level": "public",
+	}, "PUT"); err != nil {
+		return err
+	}
+
+	_, err := HTTPPostPutClient(ctx, g.projectAPI(repo, "/pages"), g.Headers(), map[string]any{
+		"pages_unique_domain_enabled": false,
+	}, "PATCH")
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// WaitForPages polls the pipeline for commit sha until it finishes. The
+// Pages deployment is part of that pipeline, so success means the site is up.
+func (g *GitLab) WaitForPages(ctx context.Context, repo string, sha string) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, g.Pages.Timeout, errPagesTimeout)
+	defer cancel()
+
+	for {
+		if err := waitPagesEvent(ctx, nil, g.Pages.Interval); err != nil {
+			return err
+		}
+
+		resp, err := HTTPGetClient(ctx, g.projectAPI(repo, "/pipelines?sha="+url.QueryEscape(sha)), g.Headers())
+		if err != nil {
+			return err
+		}
+
+		var pipelines []struct {
+			ID     uint   `json:"id"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(resp, &pipelines); err != nil {
+			return err
+		}
+
+		if len(pipelines) == 0 {
+			continue
+		}
+
+		switch pipelines[0].Status {
+		case "success":
+			return nil
+		case "failed", "canceled", "skipped":
+			return fmt.Errorf("pages_pipeline_%s:%d", pipelines[0].Status, pipelines[0].ID)
+		}
+	}
+}
+
+func (g *GitLab) LFSEndpoint(ctx context.Context, repo string) (string, map[string]string, error) {
+	return g.RepoURL(repo) + ".git/info/lfs", lfsBasicAuth(g.User, g.Token), nil
+}
+
+// PagesResolveLFS holds because CI jobs clone with LFS objects fetched, so
+// the Pages job copies the real files.
+func (g *GitLab) PagesResolveLFS(ctx context.Context, repo string) (bool, error) {
+	return true, nil
+}
+
+func (g *GitLab) RepoURL(repo string) string {
+	return fmt.Sprintf("%s/%s/%s", g.BaseURL, g.User, repo)
+}
+
+func (g *GitLab) PagesURL(repo string) string {
+	return fmt.Sprintf("https://%s.%s/%s/", strings.ToLower(g.User), g.PagesDomain, repo)
+}
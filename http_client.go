@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -20,7 +22,52 @@ type EvaluatorRequest struct {
 	PagesURL  string `json:"pages_url"`
 }
 
-func HTTPPostPutClient(url string, headers map[string]string, data any, method string) ([]byte, error) {
+// HTTPError is returned for non-2xx responses so callers can tell a 5xx
+// from a 4xx without parsing the message. RetryAfter is set when the server
+// said how long to wait, as GitHub does for rate limits.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("non-2xx response: %s - %s", e.Status, e.Body)
+}
+
+func newHTTPError(resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	httpErr := &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(b)}
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		httpErr.RetryAfter, _ = parseRetryAfter(resp.Header)
+	}
+	return httpErr
+}
+
+// doRequest sends req and records the rate limit the response reports.
+func doRequest(req *http.Request) (*http.Response, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	observeRateLimit(resp)
+	return resp, nil
+}
+
+// backoffDelay is how long the *WithBackoff helpers wait after err: their
+// own delay, or longer if the server asked for it.
+func backoffDelay(err error, delay time.Duration) time.Duration {
+	if d, ok := retryAfter(err); ok && d > delay {
+		return d
+	}
+	return delay
+}
+
+func HTTPPostPutClient(ctx context.Context, url string, headers map[string]string, data any, method string) ([]byte, error) {
 	var body io.Reader
 
 	if data != nil {
@@ -33,19 +80,19 @@ func HTTPPostPutClient(url string, headers map[string]string, data any, method s
 		body = nil
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-
 	var m string
 	switch method {
 	case "POST":
 		m = http.MethodPost
 	case "PUT":
 		m = http.MethodPut
+	case "PATCH":
+		m = http.MethodPatch
 	default:
 		return nil, errors.New("invalid method: " + method)
 	}
 
-	req, err := http.NewRequest(m, url, body)
+	req, err := http.NewRequestWithContext(ctx, m, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -55,53 +102,103 @@ func HTTPPostPutClient(url string, headers map[string]string, data any, method s
 		req.Header.Set(key, value)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, errors.New("non-2xx response: " + resp.Status + " - " + string(b))
+		return nil, newHTTPError(resp)
 	}
 
 	return io.ReadAll(resp.Body)
 }
 
-func HTTPGetClient(url string, headers map[string]string) ([]byte, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func HTTPGetClient(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	body, _, err := HTTPGetResponse(ctx, url, headers)
+	return body, err
+}
+
+// HTTPGetResponse is HTTPGetClient for callers that also need the response
+// headers, e.g. to follow pagination links.
+func HTTPGetResponse(ctx context.Context, url string, headers map[string]string) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("non-2xx response: %s - %s", resp.Status, string(b))
+		return nil, nil, newHTTPError(resp)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return body, nil
+	return body, resp.Header, nil
 }
 
-func HTTPDeleteClient(url string, headers map[string]string) error {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+// nextLink returns the rel="next" URL of an RFC 8288 Link header, as sent by
+// GitHub, Gitea and GitLab on paginated lists.
+func nextLink(h http.Header) string {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok {
+			continue
+		}
+
+		for _, p := range strings.Split(params, ";") {
+			if strings.ReplaceAll(strings.TrimSpace(p), `"`, "") == "rel=next" {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+
+	return ""
+}
+
+// GetAllPages fetches a JSON list and follows its Link headers, collecting
+// items until there is no next page or limit items have been read. A limit
+// of 0 reads every page.
+func GetAllPages[T any](ctx context.Context, url string, headers map[string]string, limit int) ([]T, error) {
+	items := []T{}
+
+	for url != "" {
+		body, h, err := HTTPGetResponse(ctx, url, headers)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []T
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+
+		if limit > 0 && len(items) >= limit {
+			return items[:limit], nil
+		}
+
+		url = nextLink(h)
+	}
+
+	return items, nil
+}
+
+func HTTPDeleteClient(ctx context.Context, url string, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
 	if err != nil {
 		return err
 	}
@@ -110,7 +207,7 @@ func HTTPDeleteClient(url string, headers map[string]string) error {
 		req.Header.Set(key, value)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(req)
 	if err != nil {
 		return err
 	}
@@ -118,25 +215,26 @@ func HTTPDeleteClient(url string, headers map[string]string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(resp.Body)
-		return errors.New("non-2xx response: " + resp.Status + " - " + string(b))
+		return newHTTPError(resp)
 	}
 
 	return nil
 }
 
-func GetWithBackoff(url string, headers map[string]string, retries int, delay time.Duration) ([]byte, error) {
+func GetWithBackoff(ctx context.Context, url string, headers map[string]string, retries int, delay time.Duration) ([]byte, error) {
 	var lastErr error
 
 	for i := 0; i < retries; i++ {
-		body, err := HTTPGetClient(url, headers)
+		body, err := HTTPGetClient(ctx, url, headers)
 		if err == nil {
 			return body, nil
 		}
 
 		lastErr = err
 		if i < retries-1 {
-			time.Sleep(delay)
+			if err := Sleep(ctx, backoffDelay(lastErr, delay)); err != nil {
+				return nil, err
+			}
 			delay *= 2
 		}
 	}
@@ -144,18 +242,20 @@ func GetWithBackoff(url string, headers map[string]string, retries int, delay ti
 	return nil, fmt.Errorf("all retries failed after %d attempts: %w", retries, lastErr)
 }
 
-func PostPutWithBackoff(url string, headers map[string]string, data any, method string, retries int, delay time.Duration) ([]byte, error) {
+func PostPutWithBackoff(ctx context.Context, url string, headers map[string]string, data any, method string, retries int, delay time.Duration) ([]byte, error) {
 	var lastErr error
 
 	for i := 0; i < retries; i++ {
-		body, err := HTTPPostPutClient(url, headers, data, method)
+		body, err := HTTPPostPutClient(ctx, url, headers, data, method)
 		if err == nil {
 			return body, nil
 		}
 
 		lastErr = err
 		if i < retries-1 {
-			time.Sleep(delay)
+			if err := Sleep(ctx, backoffDelay(lastErr, delay)); err != nil {
+				return nil, err
+			}
 			delay *= 2
 		}
 	}
@@ -163,8 +263,8 @@ func PostPutWithBackoff(url string, headers map[string]string, data any, method
 	return nil, fmt.Errorf("all retries failed after %d attempts: %w", retries, lastErr)
 }
 
-func SatisfyEvaluator(req EvaluatorRequest, url string) error {
-	_, err := PostPutWithBackoff(url, Headers(), req, "POST", 5, 2*time.Second)
+func SatisfyEvaluator(ctx context.Context, req EvaluatorRequest, url string) error {
+	_, err := PostPutWithBackoff(ctx, url, map[string]string{"Accept": "application/json"}, req, "POST", 5, 2*time.Second)
 	if err != nil {
 		return err
 	}
@@ -4,10 +4,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -32,12 +36,49 @@ type UserRequest struct {
 	Checks        []string     `json:"checks"`
 	EvaluationURL string       `json:"evaluation_url" binding:"required,url"`
 	Attachments   []Attachment `json:"attachments"`
+	Priority      int          `json:"priority"`
+	Deadline      *time.Time   `json:"deadline"`
+	NotBefore     *time.Time   `json:"not_before"`
+}
+
+// requireSecret guards read/admin endpoints with the same API_SECRET that
+// /ingest checks, passed in the X-API-Secret header.
+func requireSecret() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := os.Getenv("API_SECRET")
+		if secret == "" || c.GetHeader("X-API-Secret") != secret {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_secret"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func resendEvaluation(ctx context.Context, store *JobStore, id string, eval EvaluatorRequest, url string) {
+	if err := SatisfyEvaluator(ctx, eval, url); err != nil {
+		log.Printf("evaluator resend failed for job %s: %v", id, err)
+		return
+	}
+
+	if _, err := store.Update(id, func(rec *JobRecord) {
+		rec.AddStage("evaluator_resent")
+	}); err != nil {
+		log.Printf("job_store: %v", err)
+	}
 }
 
 func StartServer(addr string) error {
 	gin.SetMode(gin.ReleaseMode)
 
-	jobQueue = NewQueue(100, 3)
+	store, err := OpenJobStore(EnvOr("DATA_DIR", "data"),
+		EnvDuration("JOB_RETENTION", 7*24*time.Hour), EnvDuration("JOB_DEDUPE_RETENTION", 30*24*time.Hour))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	jobQueue = NewQueue(LoadQueueConfig(), store)
+	jobQueue.Throttle(JobRateLimitPause)
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 
 	defer rootCancel()
@@ -47,25 +88,49 @@ func StartServer(addr string) error {
 	r.Use(gin.Logger(), gin.Recovery())
 
 	r.GET("/", func(c *gin.Context) {
+		status := "running"
+		if jobQueue.Draining() {
+			status = "draining"
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"status": "running",
-			"time":   time.Now().Format("02-01-2006 15:04:05"),
-			"queue": gin.H{
-				"capacity": cap(jobQueue.ch),
-				"len":      len(jobQueue.ch),
-				"workers":  jobQueue.workers,
-			},
+			"status":      status,
+			"time":        time.Now().Format("02-01-2006 15:04:05"),
+			"queue":       jobQueue.Stats(),
+			"rate_limits": RateLimitStatus(),
 		})
 	})
 
 	r.POST("/ingest", func(c *gin.Context) {
+		if jobQueue.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "draining",
+				"error":  errQueueDraining.Error(),
+			})
+			return
+		}
+
+		if limit := Attachments.MaxRequestSize(); limit > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+
 		var req UserRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+					"error":   "attachment_too_large",
+					"message": fmt.Sprintf("attachment_too_large: request body over %d bytes", tooLarge.Limit),
+					"limit":   tooLarge.Limit,
+				})
+				return
+			}
+
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		if data, err := json.MarshalIndent(req, "", "  "); err == nil {
+		if data, err := json.MarshalIndent(redactAttachments(req), "", "  "); err == nil {
 			log.Println("Incoming request:\n", string(data))
 		}
 
@@ -74,7 +139,31 @@ func StartServer(addr string) error {
 			return
 		}
 
-		if err := jobQueue.TryEnqueue(Job{Req: req}, 200*time.Millisecond); err != nil {
+		// The secret has been checked; don't write it to the job log.
+		req.Secret = ""
+
+		if err := Attachments.Check(req.Attachments); err != nil {
+			var tooLarge *AttachmentTooLargeError
+			if errors.As(err, &tooLarge) {
+				body := gin.H{
+					"error":   tooLarge.Code(),
+					"message": tooLarge.Error(),
+					"size":    tooLarge.Size,
+					"limit":   tooLarge.Limit,
+				}
+				if tooLarge.Attachment != "" {
+					body["attachment"] = tooLarge.Attachment
+				}
+				c.JSON(http.StatusRequestEntityTooLarge, body)
+				return
+			}
+
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		rec, created, err := jobQueue.TryEnqueue(NewJob(req), 200*time.Millisecond)
+		if err != nil {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
 				"status": "queue_busy",
 				"error":  err.Error(),
@@ -82,7 +171,145 @@ func StartServer(addr string) error {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"status": "queued"})
+		if !created {
+			log.Printf("duplicate request for job %s (%s)", rec.Job.ID, rec.State)
+
+			// The evaluator most likely missed our callback; send it again
+			// instead of redoing the round.
+			if rec.State == JobSucceeded && rec.Result != nil {
+				go resendEvaluation(rootCtx, store, rec.Job.ID, *rec.Result, req.EvaluationURL)
+			}
+
+			c.JSON(http.StatusOK, gin.H{"status": "duplicate", "id": rec.Job.ID, "state": rec.State})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "queued", "id": rec.Job.ID})
+	})
+
+	// GitHub webhooks wake rounds waiting on a Pages build as soon as it
+	// finishes. Only enabled with GITHUB_WEBHOOK_SECRET.
+	r.POST("/webhooks/github", func(c *gin.Context) {
+		secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+		if secret == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhooks_disabled"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !VerifyWebhookSignature(secret, body, c.GetHeader("X-Hub-Signature-256")) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_signature"})
+			return
+		}
+
+		switch c.GetHeader("X-GitHub-Event") {
+		case "page_build", "deployment_status":
+			var event struct {
+				Repository struct {
+					FullName string `json:"full_name"`
+				} `json:"repository"`
+			}
+			if err := json.Unmarshal(body, &event); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			PagesEvents.Notify(event.Repository.FullName)
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	jobs := r.Group("/jobs", requireSecret())
+
+	jobs.GET("", func(c *gin.Context) {
+		state := JobState(c.Query("state"))
+
+		list := []JobStatus{}
+		for _, rec := range store.List() {
+			if state == "" || rec.State == state {
+				list = append(list, rec.Status())
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"jobs": list})
+	})
+
+	jobs.GET("/:id", func(c *gin.Context) {
+		rec, ok := store.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, rec.Status())
+	})
+
+	jobs.POST("/:id/cancel", func(c *gin.Context) {
+		if _, ok := store.Get(c.Param("id")); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+			return
+		}
+
+		rec, err := jobQueue.Cancel(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, rec.Status())
+	})
+
+	admin := r.Group("/admin", requireSecret())
+
+	admin.PUT("/workers", func(c *gin.Context) {
+		var body struct {
+			Workers *int `json:"workers" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := jobQueue.Resize(*body.Workers); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, jobQueue.Stats())
+	})
+
+	dead := r.Group("/dead-letters", requireSecret())
+
+	dead.GET("", func(c *gin.Context) {
+		list := []JobStatus{}
+		for _, rec := range store.List() {
+			if rec.State == JobFailed {
+				list = append(list, rec.Status())
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"jobs": list})
+	})
+
+	dead.POST("/:id/requeue", func(c *gin.Context) {
+		if _, ok := store.Get(c.Param("id")); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+			return
+		}
+
+		rec, err := jobQueue.Requeue(c.Param("id"), 200*time.Millisecond)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, rec.Status())
 	})
 
 	srv := &http.Server{
@@ -91,18 +318,32 @@ func StartServer(addr string) error {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	drain := EnvDuration("DRAIN_TIMEOUT", 2*time.Minute)
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, os.Interrupt)
-		<-ch
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		sig := <-ch
+		log.Printf("Received %s, draining jobs for up to %s...", sig, drain)
+
+		// Keep serving status endpoints while running jobs finish; /ingest
+		// answers 503 from here on.
+		if !jobQueue.Drain(drain) {
+			log.Println("Drain timed out, checkpointing unfinished jobs")
+		}
+
+		rootCancel()
+		if !jobQueue.Wait(10 * time.Second) {
+			log.Println("Workers did not stop in time")
+		}
+
 		log.Println("Shutting down...")
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		_ = srv.Shutdown(ctx)
 
-		rootCancel()
 		close(idleConnsClosed)
 	}()
 
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobRetrying  JobState = "retrying"
+	JobSucceeded JobState = "succeeded"
+	JobCanceled  JobState = "canceled"
+	// JobFailed jobs have used up their retries and make up the dead-letter
+	// list until they are requeued.
+	JobFailed JobState = "failed"
+)
+
+type JobStage struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+}
+
+// JobRecord is a snapshot of a job. Every change appends a new snapshot to
+// the log, and the last snapshot for an ID wins on replay. The request's
+// attachments are not part of it: they are written once, to the job's
+// attachments file, and Attachments is set. A Tombstone is what is left of a
+// job past the retention period: its ID, request key and final state, kept
+// so a late resend is still recognised as a duplicate.
+type JobRecord struct {
+	Job         Job               `json:"job"`
+	Attachments bool              `json:"attachments,omitempty"`
+	State       JobState          `json:"state"`
+	Stages      []JobStage        `json:"stages,omitempty"`
+	RepoURL     string            `json:"repo_url,omitempty"`
+	PagesURL    string            `json:"pages_url,omitempty"`
+	CommitSHA   string            `json:"commit_sha,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	ErrorClass  ErrorClass        `json:"error_class,omitempty"`
+	Stack       string            `json:"stack,omitempty"`
+	StuckStage  string            `json:"stuck_stage,omitempty"`
+	NextAttempt *time.Time        `json:"next_attempt,omitempty"`
+	Result      *EvaluatorRequest `json:"result,omitempty"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Deleted     bool              `json:"deleted,omitempty"`
+	Tombstone   bool              `json:"tombstone,omitempty"`
+}
+
+func (r JobRecord) Pending() bool {
+	return r.State == JobQueued || r.State == JobRunning || r.State == JobRetrying
+}
+
+// Overdue reports whether the job missed its deadline: it is still pending
+// past it, or it finished after it.
+func (r JobRecord) Overdue() bool {
+	if r.Pending() {
+		return r.Job.Overdue(time.Now())
+	}
+	return r.Job.Overdue(r.UpdatedAt)
+}
+
+func (r *JobRecord) AddStage(name string) {
+	r.Stages = append(r.Stages, JobStage{Name: name, At: time.Now()})
+}
+
+// JobStatus is the public view of a job. It leaves out the request body,
+// which can carry large attachments.
+type JobStatus struct {
+	ID          string     `json:"id"`
+	Task        string     `json:"task"`
+	Round       uint       `json:"round"`
+	Email       string     `json:"email"`
+	Nonce       string     `json:"nonce"`
+	State       JobState   `json:"state"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Stages      []JobStage `json:"stages"`
+	Attempt     int        `json:"attempt"`
+	Priority    int        `json:"priority"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	Overdue     bool       `json:"overdue"`
+	RepoURL     string     `json:"repo_url,omitempty"`
+	PagesURL    string     `json:"pages_url,omitempty"`
+	CommitSHA   string     `json:"commit_sha,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	ErrorClass  ErrorClass `json:"error_class,omitempty"`
+	Stack       string     `json:"stack,omitempty"`
+	StuckStage  string     `json:"stuck_stage,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+func (r JobRecord) Status() JobStatus {
+	stages := r.Stages
+	if stages == nil {
+		stages = []JobStage{}
+	}
+
+	var next *time.Time
+	if r.State == JobRetrying {
+		next = r.NextAttempt
+	}
+
+	return JobStatus{
+		ID:          r.Job.ID,
+		Task:        r.Job.Req.Task,
+		Round:       r.Job.Req.Round,
+		Email:       r.Job.Req.Email,
+		Nonce:       r.Job.Req.Nonce,
+		State:       r.State,
+		ReceivedAt:  r.Job.ReceivedAt,
+		UpdatedAt:   r.UpdatedAt,
+		Stages:      stages,
+		Attempt:     r.Job.Attempt,
+		Priority:    r.Job.Priority,
+		Deadline:    r.Job.Deadline,
+		NotBefore:   r.Job.NotBefore,
+		Overdue:     r.Overdue(),
+		RepoURL:     r.RepoURL,
+		PagesURL:    r.PagesURL,
+		CommitSHA:   r.CommitSHA,
+		LastError:   r.LastError,
+		ErrorClass:  r.ErrorClass,
+		Stack:       r.Stack,
+		StuckStage:  r.StuckStage,
+		NextAttempt: next,
+	}
+}
+
+// JobStore is an append-only, fsynced log of job snapshots under a data
+// directory. It is compacted on open so the log only grows between restarts;
+// finished jobs are kept for the retention period so they can be looked up,
+// and their tombstones for the dedupe period so resends are still caught.
+// Attachments live in one file per job under attachments/, so neither the
+// log nor memory holds them more than once.
+type JobStore struct {
+	mu        sync.Mutex
+	path      string
+	attDir    string
+	file      *os.File
+	records   map[string]*JobRecord
+	byKey     map[string]string
+	tombs     map[string]JobRecord
+	order     []string
+	retention time.Duration
+	dedupe    time.Duration
+}
+
+// requestKey identifies a request for deduplication. Evaluators resend the
+// exact same request when they time out waiting for us.
+func requestKey(req UserRequest) string {
+	return strings.Join([]string{req.Email, req.Task, strconv.Itoa(int(req.Round)), req.Nonce}, "\x00")
+}
+
+// OpenJobStore opens the store under dir. Finished jobs are dropped after
+// retention; their request keys are remembered until dedupe has passed.
+func OpenJobStore(dir string, retention, dedupe time.Duration) (*JobStore, error) {
+	attDir := filepath.Join(dir, "attachments")
+	if err := os.MkdirAll(attDir, 0o755); err != nil {
+		return nil, fmt.Errorf("job_store_mkdir: %w", err)
+	}
+
+	s := &JobStore{
+		path:      filepath.Join(dir, "jobs.log"),
+		attDir:    attDir,
+		records:   map[string]*JobRecord{},
+		byKey:     map[string]string{},
+		tombs:     map[string]JobRecord{},
+		retention: retention,
+		dedupe:    dedupe,
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("job_store_open: %w", err)
+	}
+	s.file = f
+
+	return s, nil
+}
+
+func (s *JobStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("job_store_open: %w", err)
+	}
+	defer f.Close()
+
+	// Lines aren't length-limited: logs from before attachments files hold
+	// every request inline.
+	r := bufio.NewReader(f)
+
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("job_store_read: %w", err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		line++
+
+		var rec JobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			// A crash mid-write can leave a torn final line; anything before
+			// it was fsynced and is still valid.
+			log.Printf("job_store: skipping unreadable line %d: %v", line, err)
+			continue
+		}
+
+		s.apply(rec)
+	}
+}
+
+func (s *JobStore) apply(rec JobRecord) {
+	id := rec.Job.ID
+
+	if rec.Deleted {
+		s.remove(id)
+		return
+	}
+
+	if rec.Tombstone {
+		s.remove(id)
+		s.tombs[requestKey(rec.Job.Req)] = rec
+		return
+	}
+
+	if _, ok := s.records[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.records[id] = &rec
+	s.byKey[requestKey(rec.Job.Req)] = id
+}
+
+func (s *JobStore) remove(id string) {
+	if rec, ok := s.records[id]; ok {
+		key := requestKey(rec.Job.Req)
+		if s.byKey[key] == id {
+			delete(s.byKey, key)
+		}
+	}
+	delete(s.records, id)
+}
+
+func (s *JobStore) attachmentsPath(id string) string {
+	return filepath.Join(s.attDir, id+".json")
+}
+
+// saveAttachments durably writes the job's attachments file.
+func (s *JobStore) saveAttachments(id string, atts []Attachment) error {
+	data, err := json.Marshal(atts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(s.attachmentsPath(id))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// detach moves the request's attachments out of rec into its attachments
+// file.
+func (s *JobStore) detach(rec *JobRecord) error {
+	if len(rec.Job.Req.Attachments) == 0 {
+		return nil
+	}
+
+	if err := s.saveAttachments(rec.Job.ID, rec.Job.Req.Attachments); err != nil {
+		return err
+	}
+	rec.Job.Req.Attachments = nil
+	rec.Attachments = true
+	return nil
+}
+
+// LoadJob returns the job of rec with the request's attachments read back
+// in, ready to run.
+func (s *JobStore) LoadJob(rec JobRecord) (Job, error) {
+	job := rec.Job
+	if !rec.Attachments {
+		return job, nil
+	}
+
+	data, err := os.ReadFile(s.attachmentsPath(job.ID))
+	if err != nil {
+		return Job{}, fmt.Errorf("job_store_attachments: %w", err)
+	}
+	if err := json.Unmarshal(data, &job.Req.Attachments); err != nil {
+		return Job{}, fmt.Errorf("job_store_attachments: %w", err)
+	}
+	return job, nil
+}
+
+// removeStaleAttachments deletes attachments files of jobs the store no
+// longer has, such as those of jobs that never made it into the log.
+func (s *JobStore) removeStaleAttachments() {
+	entries, err := os.ReadDir(s.attDir)
+	if err != nil {
+		log.Printf("job_store: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if rec, ok := s.records[id]; ok && rec.Attachments {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.attDir, e.Name())); err != nil {
+			log.Printf("job_store: %v", err)
+		}
+	}
+}
+
+// tombstone is what compaction keeps of a job past the retention period.
+func tombstone(rec JobRecord) JobRecord {
+	req := rec.Job.Req
+	return JobRecord{
+		Job: Job{
+			ID:  rec.Job.ID,
+			Req: UserRequest{Email: req.Email, Task: req.Task, Round: req.Round, Nonce: req.Nonce},
+		},
+		State:     rec.State,
+		UpdatedAt: rec.UpdatedAt,
+		Tombstone: true,
+	}
+}
+
+// compact rewrites the log with one snapshot per job, turning finished jobs
+// older than the retention period into tombstones and dropping tombstones
+// older than the dedupe period. Attachments still inline in older logs are
+// moved to attachments files on the way.
+func (s *JobStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("job_store_compact: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	var order []string
+
+	for _, id := range s.order {
+		rec, ok := s.records[id]
+		if !ok {
+			continue
+		}
+
+		if !rec.Pending() && time.Since(rec.UpdatedAt) > s.retention {
+			s.remove(id)
+			s.tombs[requestKey(rec.Job.Req)] = tombstone(*rec)
+			continue
+		}
+
+		if err := s.detach(rec); err != nil {
+			f.Close()
+			return fmt.Errorf("job_store_compact: %w", err)
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("job_store_compact: %w", err)
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+		order = append(order, id)
+	}
+
+	for key, tomb := range s.tombs {
+		if time.Since(tomb.UpdatedAt) > s.dedupe {
+			delete(s.tombs, key)
+			continue
+		}
+
+		data, err := json.Marshal(tomb)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("job_store_compact: %w", err)
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("job_store_compact: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("job_store_compact: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("job_store_compact: %w", err)
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("job_store_compact: %w", err)
+	}
+
+	s.order = order
+	s.removeStaleAttachments()
+	return nil
+}
+
+func (s *JobStore) write(rec JobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// Insert durably records a new job unless one with the same request key
+// exists, in which case the existing record is returned and created is false.
+// For a job past the retention period that is its tombstone. The returned
+// record doesn't carry the attachments; see LoadJob.
+func (s *JobStore) Insert(rec JobRecord) (JobRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := requestKey(rec.Job.Req)
+	if id, ok := s.byKey[key]; ok {
+		return *s.records[id], false, nil
+	}
+	if tomb, ok := s.tombs[key]; ok {
+		return tomb, false, nil
+	}
+
+	if err := s.detach(&rec); err != nil {
+		return JobRecord{}, false, fmt.Errorf("job_store_write: %w", err)
+	}
+
+	rec.UpdatedAt = time.Now()
+	if err := s.write(rec); err != nil {
+		return JobRecord{}, false, fmt.Errorf("job_store_write: %w", err)
+	}
+
+	s.apply(rec)
+	return rec, true, nil
+}
+
+// Update applies fn to a copy of the job's record and persists the result.
+func (s *JobStore) Update(id string, fn func(*JobRecord)) (JobRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.records[id]
+	if !ok {
+		return JobRecord{}, fmt.Errorf("job_not_found:%s", id)
+	}
+
+	rec := *cur
+	rec.Stages = append([]JobStage(nil), cur.Stages...)
+	fn(&rec)
+	rec.UpdatedAt = time.Now()
+
+	if err := s.write(rec); err != nil {
+		return JobRecord{}, fmt.Errorf("job_store_write: %w", err)
+	}
+
+	s.apply(rec)
+	return rec, nil
+}
+
+func (s *JobStore) Get(id string) (JobRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[id]
+	if !ok {
+		return JobRecord{}, false
+	}
+	return *rec, true
+}
+
+// List returns every known job in the order it was first recorded.
+func (s *JobStore) List() []JobRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recs := make([]JobRecord, 0, len(s.records))
+	for _, id := range s.order {
+		if rec, ok := s.records[id]; ok {
+			recs = append(recs, *rec)
+		}
+	}
+
+	return recs
+}
+
+func (s *JobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := JobRecord{Job: Job{ID: id}, UpdatedAt: time.Now(), Deleted: true}
+	if err := s.write(rec); err != nil {
+		return fmt.Errorf("job_store_write: %w", err)
+	}
+
+	if err := os.Remove(s.attachmentsPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("job_store: %v", err)
+	}
+
+	s.apply(rec)
+	return nil
+}
+
+// Pending returns queued, retrying and in-flight jobs in the order they were
+// first recorded. Jobs that were running when the process died are included
+// so they get replayed.
+func (s *JobStore) Pending() []JobRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recs []JobRecord
+	for _, id := range s.order {
+		if rec, ok := s.records[id]; ok && rec.Pending() {
+			recs = append(recs, *rec)
+		}
+	}
+
+	return recs
+}
+
+func (s *JobStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// largeAttachment is a data URL whose encoding is longer than the 64 MB a
+// log line used to be allowed.
+func largeAttachment(t *testing.T, name string) Attachment {
+	t.Helper()
+
+	data := bytes.Repeat([]byte{0x5a}, 50<<20)
+	return Attachment{
+		Name: name,
+		URL:  "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func TestJobStoreRoundTripsLargeJob(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := UserRequest{Email: "a@example.com", Task: "big-task", Round: 1, Nonce: "n1"}
+	req.Attachments = []Attachment{largeAttachment(t, "big.bin"), {Name: "small.txt", URL: "data:text/plain;base64,aGk="}}
+	job := NewJob(req)
+
+	rec, created, err := store.Insert(JobRecord{Job: job, State: JobQueued})
+	if err != nil || !created {
+		t.Fatalf("Insert = %v, %v", created, err)
+	}
+	if rec.Job.Req.Attachments != nil || !rec.Attachments {
+		t.Fatal("Insert kept the attachments on the record")
+	}
+
+	for _, stage := range []string{"running", "repo_created", "files_committed", "pages_enabled", "pages_built"} {
+		if _, err := store.Update(job.ID, func(rec *JobRecord) {
+			rec.State = JobRunning
+			rec.AddStage(stage)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "jobs.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 64<<10 {
+		t.Fatalf("jobs.log is %d bytes; snapshots should not carry attachments", info.Size())
+	}
+
+	store, err = OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	pending := store.Pending()
+	if len(pending) != 1 || pending[0].Job.ID != job.ID {
+		t.Fatalf("Pending = %+v", pending)
+	}
+	if got := len(pending[0].Stages); got != 5 {
+		t.Fatalf("replayed %d stages, want 5", got)
+	}
+
+	loaded, err := store.LoadJob(pending[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Req.Attachments) != 2 {
+		t.Fatalf("loaded %d attachments, want 2", len(loaded.Req.Attachments))
+	}
+	for i, att := range req.Attachments {
+		if loaded.Req.Attachments[i] != att {
+			t.Fatalf("attachment %s did not round-trip", att.Name)
+		}
+	}
+
+	if err := store.Delete(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "attachments", job.ID+".json")); !os.IsNotExist(err) {
+		t.Fatalf("attachments file left after Delete: %v", err)
+	}
+}
+
+func TestJobStoreMovesInlineAttachmentsOut(t *testing.T) {
+	dir := t.TempDir()
+
+	// A log written before attachments files, with the request inline and
+	// its line over the old 64 MB limit.
+	req := UserRequest{Email: "a@example.com", Task: "old-task", Round: 2, Nonce: "n2"}
+	req.Attachments = []Attachment{largeAttachment(t, "a.bin"), largeAttachment(t, "b.bin")}
+	job := NewJob(req)
+
+	line, err := json.Marshal(JobRecord{Job: job, State: JobQueued, UpdatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "jobs.log"), append(line, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// An attachments file no job refers to.
+	if err := os.MkdirAll(filepath.Join(dir, "attachments"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "attachments", "gone.json")
+	if err := os.WriteFile(stale, []byte("[]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	rec, ok := store.Get(job.ID)
+	if !ok {
+		t.Fatal("job not replayed")
+	}
+	if rec.Job.Req.Attachments != nil {
+		t.Fatal("attachments still held on the record")
+	}
+
+	loaded, err := store.LoadJob(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Req.Attachments) != 2 || loaded.Req.Attachments[1] != req.Attachments[1] {
+		t.Fatal("attachments did not survive compaction")
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale attachments file kept: %v", err)
+	}
+}
+
+func TestJobStoreRemembersKeysPastRetention(t *testing.T) {
+	dir := t.TempDir()
+
+	// A job that finished two hours ago, before a one hour retention.
+	req := UserRequest{Email: "a@example.com", Task: "done-task", Round: 1, Nonce: "n1"}
+	job := NewJob(req)
+	line, err := json.Marshal(JobRecord{Job: job, State: JobSucceeded, UpdatedAt: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "jobs.log"), append(line, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenJobStore(dir, time.Hour, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := store.Get(job.ID); ok {
+			t.Fatal("job kept past the retention period")
+		}
+
+		rec, created, err := store.Insert(JobRecord{Job: NewJob(req), State: JobQueued})
+		if err != nil || created {
+			t.Fatalf("Insert after retention = %v, %v; want a duplicate", created, err)
+		}
+		if rec.Job.ID != job.ID || rec.State != JobSucceeded {
+			t.Fatalf("duplicate of %s (%s), want %s (succeeded)", rec.Job.ID, rec.State, job.ID)
+		}
+		store.Close()
+	}
+
+	// Past the dedupe period the key is forgotten too.
+	store, err := OpenJobStore(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, created, err := store.Insert(JobRecord{Job: NewJob(req), State: JobQueued}); err != nil || !created {
+		t.Fatalf("Insert after dedupe period = %v, %v; want a new job", created, err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// LFSHost is implemented by hosts with a Git LFS server next to their git
+// remote. Large attachments are uploaded there and committed as pointers,
+// as long as the host's Pages build resolves them.
+type LFSHost interface {
+	// LFSEndpoint returns the repo's LFS server URL (ending in
+	// ".git/info/lfs") and the headers that authenticate to it.
+	LFSEndpoint(ctx context.Context, repo string) (string, map[string]string, error)
+	// PagesResolveLFS reports whether repo's published site serves the files
+	// LFS pointers stand for rather than the pointer text.
+	PagesResolveLFS(ctx context.Context, repo string) (bool, error)
+}
+
+// lfsBasicAuth is the header LFS servers take credentials in: the same
+// user and token git itself would push with.
+func lfsBasicAuth(user, token string) map[string]string {
+	return map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+token)),
+	}
+}
+
+// LFSObject identifies content stored with Git LFS.
+type LFSObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// Pointer is the file committed in place of the content.
+func (o LFSObject) Pointer() []byte {
+	return []byte(fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", o.OID, o.Size))
+}
+
+// hashLFSObject reads r to the end for its oid and size.
+func hashLFSObject(r io.Reader) (LFSObject, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return LFSObject{}, err
+	}
+	return LFSObject{OID: hex.EncodeToString(h.Sum(nil)), Size: n}, nil
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type lfsBatchObject struct {
+	LFSObject
+	Actions map[string]lfsAction `json:"actions"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// lfsTransferClient uploads content, which can take far longer than the API
+// client's timeout allows; the job's context bounds it instead.
+var lfsTransferClient = &http.Client{}
+
+// UploadLFS stores the content open returns with the repo's LFS server,
+// using the batch API and its basic transfer. The content is streamed twice,
+// once to hash it and once to upload it, and never held in memory whole.
+// Objects the server already has aren't sent again.
+func UploadLFS(ctx context.Context, host LFSHost, repo string, open func() io.Reader) (LFSObject, error) {
+	obj, err := hashLFSObject(open())
+	if err != nil {
+		return LFSObject{}, fmt.Errorf("lfs_hash: %w", err)
+	}
+
+	endpoint, auth, err := host.LFSEndpoint(ctx, repo)
+	if err != nil {
+		return LFSObject{}, err
+	}
+
+	headers := map[string]string{"Accept": lfsMediaType, "Content-Type": lfsMediaType}
+	for k, v := range auth {
+		headers[k] = v
+	}
+
+	resp, err := HTTPPostPutClient(ctx, endpoint+"/objects/batch", headers, map[string]any{
+		"operation": "upload",
+		"transfers": []string{"basic"},
+		"objects":   []LFSObject{obj},
+		"hash_algo": "sha256",
+	}, "POST")
+	if err != nil {
+		return LFSObject{}, fmt.Errorf("lfs_batch: %w", err)
+	}
+
+	var batch struct {
+		Objects []lfsBatchObject `json:"objects"`
+	}
+	if err := json.Unmarshal(resp, &batch); err != nil {
+		return LFSObject{}, err
+	}
+	if len(batch.Objects) != 1 {
+		return LFSObject{}, fmt.Errorf("lfs_batch: expected 1 object, got %d", len(batch.Objects))
+	}
+
+	res := batch.Objects[0]
+	if res.Error != nil {
+		return LFSObject{}, &HTTPError{
+			StatusCode: res.Error.Code,
+			Status:     http.StatusText(res.Error.Code),
+			Body:       "lfs_object: " + res.Error.Message,
+		}
+	}
+
+	upload, ok := res.Actions["upload"]
+	if !ok {
+		return obj, nil
+	}
+
+	if err := lfsUpload(ctx, upload, obj, open()); err != nil {
+		return LFSObject{}, fmt.Errorf("lfs_upload: %w", err)
+	}
+
+	if verify, ok := res.Actions["verify"]; ok {
+		h := map[string]string{"Accept": lfsMediaType, "Content-Type": lfsMediaType}
+		for k, v := range verify.Header {
+			h[k] = v
+		}
+		if _, err := HTTPPostPutClient(ctx, verify.Href, h, obj, "POST"); err != nil {
+			return LFSObject{}, fmt.Errorf("lfs_verify: %w", err)
+		}
+	}
+
+	return obj, nil
+}
+
+// lfsUpload PUTs the content to where the batch response said.
+func lfsUpload(ctx context.Context, action lfsAction, obj LFSObject, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, action.Href, body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = obj.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := lfsTransferClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newHTTPError(resp)
+	}
+	return nil
+}
+
+// lfsAttributes returns the repo's .gitattributes with paths tracked by LFS,
+// keeping whatever it already had.
+func lfsAttributes(ctx context.Context, host RepoHost, repo string, paths []string) (FileChange, error) {
+	_, current, err := host.GetFile(ctx, repo, ".gitattributes")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return FileChange{}, err
+	}
+
+	var b bytes.Buffer
+	b.Write(current)
+	if b.Len() > 0 && !bytes.HasSuffix(current, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+
+	for _, p := range paths {
+		// Spaces would end the pattern; git-lfs writes them this way too.
+		fmt.Fprintf(&b, "%s filter=lfs diff=lfs merge=lfs -text\n", strings.ReplaceAll(p, " ", "[[:space:]]"))
+	}
+
+	return FileChange{Path: ".gitattributes", Data: b.Bytes()}, nil
+}
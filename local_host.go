@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// LocalHost is a RepoHost backed by bare git repositories under Root, driven
+// through the git CLI. Pages are served straight from each repo's default
+// branch by a built-in static file server on PagesAddr, so a site is "built"
+// as soon as its commit is on the branch.
+type LocalHost struct {
+	Root      string
+	Branch    string
+	Name      string
+	Email     string
+	PagesAddr string
+	PagesBase string
+
+	serveOnce sync.Once
+	serveErr  error
+}
+
+func NewLocalHostFromEnv() *LocalHost {
+	addr := EnvOr("LOCAL_PAGES_ADDR", "127.0.0.1:8766")
+
+	return &LocalHost{
+		Root:      EnvOr("LOCAL_REPO_ROOT", filepath.Join(EnvOr("DATA_DIR", "data"), "repos")),
+		Branch:    "main",
+		Name:      EnvOr("GITHUB_NAME", "sdt"),
+		Email:     EnvOr("GITHUB_EMAIL", "sdt@localhost"),
+		PagesAddr: addr,
+		PagesBase: strings.TrimSuffix(EnvOr("LOCAL_PAGES_URL", "http://"+addr), "/"),
+	}
+}
+
+func (l *LocalHost) repoPath(name string) (string, error) {
+	if !repoNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid_repo_name:%s", name)
+	}
+	return filepath.Join(l.Root, name+".git"), nil
+}
+
+// existingRepo returns the path of a repo, wrapping ErrNotFound if it
+// doesn't exist.
+func (l *LocalHost) existingRepo(name string) (string, error) {
+	dir, err := l.repoPath(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", fmt.Errorf("repo %s: %w", name, ErrNotFound)
+	}
+	return dir, nil
+}
+
+// git runs a git command against dir and returns its trimmed stdout.
+func (l *LocalHost) git(ctx context.Context, dir string, env []string, stdin []byte, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// resolve runs rev-parse --verify on rev, returning "" if it doesn't resolve.
+func (l *LocalHost) resolve(ctx context.Context, dir, rev string) (string, error) {
+	sha, err := l.git(ctx, dir, nil, nil, "rev-parse", "--verify", "--quiet", rev)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+	return sha, nil
+}
+
+// head returns the commit the default branch points at, or "" for a repo
+// that has no commits yet.
+func (l *LocalHost) head(ctx context.Context, dir string) (string, error) {
+	return l.resolve(ctx, dir, "refs/heads/"+l.Branch)
+}
+
+func (l *LocalHost) Check(ctx context.Context) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git_check_failed: %w", err)
+	}
+
+	if err := os.MkdirAll(l.Root, 0o755); err != nil {
+		return fmt.Errorf("git_check_failed: %w", err)
+	}
+
+	l.serveOnce.Do(func() {
+		ln, err := net.Listen("tcp", l.PagesAddr)
+		if err != nil {
+			l.serveErr = fmt.Errorf("pages_listen: %w", err)
+			return
+		}
+
+		log.Printf("Serving local pages on %s", l.PagesBase)
+		go func() {
+			if err := http.Serve(ln, l); err != nil {
+				log.Printf("local pages server stopped: %v", err)
+			}
+		}()
+	})
+
+	return l.serveErr
+}
+
+func (l *LocalHost) ListRepositories(ctx context.Context) ([]Repository, error) {
+	entries, err := os.ReadDir(l.Root)
+	if os.IsNotExist(err) {
+		return []Repository{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []Repository{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".git")
+		if !e.IsDir() || !ok {
+			continue
+		}
+		repos = append(repos, Repository{Name: name, HTMLURL: l.RepoURL(name)})
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+
+	return repos, nil
+}
+
+func (l *LocalHost) RepositoryExists(ctx context.Context, name string) (bool, error) {
+	_, err := l.existingRepo(name)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *LocalHost) CreateRepository(ctx context.Context, name string) error {
+	dir, err := l.repoPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("repo_exists:%s", name)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "init", "--quiet", "--bare", "--initial-branch", l.Branch, dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git init: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func (l *LocalHost) DeleteRepository(ctx context.Context, name string) error {
+	dir, err := l.existingRepo(name)
+	if err != nil {
+		return err
+	}
+	if err := requireManaged(ctx, l, name); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ArchiveRepository renames the repo's directory; bare repos have no
+// read-only flag to set.
+func (l *LocalHost) ArchiveRepository(ctx context.Context, name, newName string) error {
+	dir, err := l.existingRepo(name)
+	if err != nil {
+		return err
+	}
+	if err := requireManaged(ctx, l, name); err != nil {
+		return err
+	}
+
+	dst, err := l.repoPath(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("repo_exists:%s", newName)
+	}
+
+	return os.Rename(dir, dst)
+}
+
+// UpdateMetadata writes the description to the repo's description file,
+// where git's own tools look for it, and keeps the homepage and topics in
+// its config.
+func (l *LocalHost) UpdateMetadata(ctx context.Context, repo string, meta RepoMetadata) error {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "description"), []byte(meta.Description+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	if _, err := l.git(ctx, dir, nil, nil, "config", "sdt.homepage", meta.Homepage); err != nil {
+		return err
+	}
+	_, err = l.git(ctx, dir, nil, nil, "config", "sdt.topics", strings.Join(meta.Topics, " "))
+	return err
+}
+
+func (l *LocalHost) GetFile(ctx context.Context, repo, path string) (string, []byte, error) {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return l.readBlob(ctx, dir, path)
+}
+
+// readBlob returns the SHA and content of path on the default branch.
+func (l *LocalHost) readBlob(ctx context.Context, dir, path string) (string, []byte, error) {
+	sha, err := l.resolve(ctx, dir, "refs/heads/"+l.Branch+":"+path)
+	if err != nil {
+		return "", nil, err
+	}
+	if sha == "" {
+		return "", nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "--git-dir", dir, "cat-file", "blob", sha)
+	data, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("git cat-file: %w", err)
+	}
+
+	return sha, data, nil
+}
+
+// Commit stages the files into a throwaway index seeded from the branch
+// head, writes a tree and a commit from it, and moves the branch only if it
+// still points at the head the commit was built on.
+func (l *LocalHost) Commit(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := l.head(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+
+	sha, err := l.commitFiles(ctx, dir, message, files, parent)
+	if err != nil {
+		return "", err
+	}
+
+	// An empty old value makes update-ref require that the branch doesn't
+	// exist yet.
+	if _, err := l.git(ctx, dir, nil, nil, "update-ref", "refs/heads/"+l.Branch, sha, parent); err != nil {
+		return "", err
+	}
+
+	return sha, nil
+}
+
+// ResetBranch moves the branch to a new root commit holding only files.
+func (l *LocalHost) ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	if err := requireManaged(ctx, l, repo); err != nil {
+		return "", err
+	}
+
+	sha, err := l.commitFiles(ctx, dir, message, files, "")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := l.git(ctx, dir, nil, nil, "update-ref", "refs/heads/"+l.Branch, sha); err != nil {
+		return "", err
+	}
+
+	return sha, nil
+}
+
+// commitFiles writes a commit of files on top of parent's tree, or of just
+// files when parent is "", without moving any ref.
+func (l *LocalHost) commitFiles(ctx context.Context, dir, message string, files []FileChange, parent string) (string, error) {
+	tmp, err := os.MkdirTemp("", "sdt-index-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	env := []string{
+		"GIT_INDEX_FILE=" + filepath.Join(tmp, "index"),
+		"GIT_AUTHOR_NAME=" + l.Name,
+		"GIT_AUTHOR_EMAIL=" + l.Email,
+		"GIT_COMMITTER_NAME=" + l.Name,
+		"GIT_COMMITTER_EMAIL=" + l.Email,
+	}
+
+	if parent != "" {
+		if _, err := l.git(ctx, dir, env, nil, "read-tree", parent); err != nil {
+			return "", err
+		}
+	}
+
+	for _, f := range files {
+		blob, err := l.git(ctx, dir, env, f.Data, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", fmt.Errorf("hash_object(%s): %w", f.Path, err)
+		}
+
+		if _, err := l.git(ctx, dir, env, nil, "update-index", "--add", "--cacheinfo", "100644,"+blob+","+f.Path); err != nil {
+			return "", fmt.Errorf("update_index(%s): %w", f.Path, err)
+		}
+	}
+
+	tree, err := l.git(ctx, dir, env, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", tree, "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return l.git(ctx, dir, env, nil, args...)
+}
+
+func (l *LocalHost) LastCommit(ctx context.Context, repo string) (string, error) {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	sha, err := l.head(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		return "", fmt.Errorf("no commits found")
+	}
+
+	return sha, nil
+}
+
+// CreateRelease force-writes an annotated tag; there are no releases
+// locally, so the tag message carries the notes.
+func (l *LocalHost) CreateRelease(ctx context.Context, repo string, rel Release) error {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return err
+	}
+
+	env := []string{
+		"GIT_COMMITTER_NAME=" + l.Name,
+		"GIT_COMMITTER_EMAIL=" + l.Email,
+	}
+	_, err = l.git(ctx, dir, env, []byte(rel.Message()), "tag", "--force", "--annotate", "--cleanup=verbatim", "--file=-", rel.Tag, rel.SHA)
+	return err
+}
+
+func (l *LocalHost) SetupPages(ctx context.Context, repo string) error {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.git(ctx, dir, nil, nil, "config", "sdt.pages", "true")
+	return err
+}
+
+func (l *LocalHost) pagesEnabled(ctx context.Context, dir string) bool {
+	v, err := l.git(ctx, dir, nil, nil, "config", "--bool", "sdt.pages")
+	return err == nil && v == "true"
+}
+
+func (l *LocalHost) WaitForPages(ctx context.Context, repo, sha string) error {
+	dir, err := l.existingRepo(repo)
+	if err != nil {
+		return err
+	}
+
+	if !l.pagesEnabled(ctx, dir) {
+		return fmt.Errorf("pages_not_enabled:%s", repo)
+	}
+
+	head, err := l.head(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if head != sha {
+		return errPagesTimeout
+	}
+
+	return nil
+}
+
+func (l *LocalHost) RepoURL(repo string) string {
+	dir, _ := filepath.Abs(filepath.Join(l.Root, repo+".git"))
+	return "file://" + filepath.ToSlash(dir)
+}
+
+func (l *LocalHost) PagesURL(repo string) string {
+	return fmt.Sprintf("%s/%s/", l.PagesBase, repo)
+}
+
+// ServeHTTP is the Pages server: /<repo>/<path> serves path from the repo's
+// default branch, with index.html for directories.
+func (l *LocalHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repo, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if repo == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if file == "" && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	file = strings.TrimPrefix(path.Clean("/"+file), "/")
+	if file == "" || strings.HasSuffix(r.URL.Path, "/") {
+		file = path.Join(file, "index.html")
+	}
+
+	dir, err := l.existingRepo(repo)
+	if err != nil || !l.pagesEnabled(r.Context(), dir) {
+		http.NotFound(w, r)
+		return
+	}
+
+	sha, data, err := l.readBlob(r.Context(), dir, file)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(file)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", `"`+sha+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
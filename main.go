@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -15,11 +16,13 @@ func main() {
 		log.Fatal("⚠️  No .env file found (using system environment)")
 	}
 
-	if err := InitOpenAI(); err != nil {
+	ctx := context.Background()
+
+	if err := InitOpenAI(ctx); err != nil {
 		log.Fatal("⚠️  OpenAI error: ", err)
 	}
 
-	if err := InitGit(); err != nil {
+	if err := InitGit(ctx); err != nil {
 		log.Fatal("⚠️  Git error: ", err)
 	}
 
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryFile struct {
+	sha  string
+	data []byte
+}
+
+type memoryRepo struct {
+	id       uint
+	files    map[string]memoryFile
+	commits  []string
+	pages    bool
+	branches map[string]memoryBranch
+	// pulls are the open pull requests; merging one removes it.
+	pulls    []PullRequest
+	lastPull int
+	meta     RepoMetadata
+	releases map[string]Release
+}
+
+// memoryBranch is a side branch one commit ahead of the default branch.
+type memoryBranch struct {
+	sha   string
+	files []FileChange
+}
+
+// MemoryHost is a RepoHost that keeps everything in process memory. It is
+// used for dry runs (REPO_HOST=memory) and in tests; Pages are "built" as
+// soon as they are enabled.
+type MemoryHost struct {
+	Owner string
+
+	mu     sync.Mutex
+	repos  map[string]*memoryRepo
+	nextID uint
+}
+
+func NewMemoryHost(owner string) *MemoryHost {
+	return &MemoryHost{
+		Owner: owner,
+		repos: map[string]*memoryRepo{},
+	}
+}
+
+// gitHash returns the SHA-1 git would give an object of the given type.
+func gitHash(kind string, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", kind, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m *MemoryHost) repo(name string) (*memoryRepo, error) {
+	r, ok := m.repos[name]
+	if !ok {
+		return nil, fmt.Errorf("repo %s: %w", name, ErrNotFound)
+	}
+	return r, nil
+}
+
+func (m *MemoryHost) Check(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryHost) ListRepositories(ctx context.Context) ([]Repository, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	repos := make([]Repository, 0, len(m.repos))
+	for name, r := range m.repos {
+		repos = append(repos, Repository{
+			ID:      r.id,
+			Name:    name,
+			HTMLURL: m.RepoURL(name),
+		})
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].ID < repos[j].ID })
+
+	return repos, nil
+}
+
+func (m *MemoryHost) RepositoryExists(ctx context.Context, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.repos[name]
+	return ok, nil
+}
+
+func (m *MemoryHost) CreateRepository(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.repos[name]; ok {
+		return fmt.Errorf("repo_exists:%s", name)
+	}
+
+	m.nextID++
+	m.repos[name] = &memoryRepo{
+		id:       m.nextID,
+		files:    map[string]memoryFile{},
+		branches: map[string]memoryBranch{},
+		releases: map[string]Release{},
+	}
+	return nil
+}
+
+func (m *MemoryHost) DeleteRepository(ctx context.Context, name string) error {
+	if err := requireManaged(ctx, m, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.repo(name); err != nil {
+		return err
+	}
+
+	delete(m.repos, name)
+	return nil
+}
+
+func (m *MemoryHost) ArchiveRepository(ctx context.Context, name, newName string) error {
+	if err := requireManaged(ctx, m, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.repos[newName]; ok {
+		return fmt.Errorf("repo_exists:%s", newName)
+	}
+
+	delete(m.repos, name)
+	m.repos[newName] = r
+	return nil
+}
+
+func (m *MemoryHost) UpdateMetadata(ctx context.Context, name string, meta RepoMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(name)
+	if err != nil {
+		return err
+	}
+
+	r.meta = meta
+	return nil
+}
+
+func (m *MemoryHost) GetFile(ctx context.Context, repo, path string) (string, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, ok := r.files[path]
+	if !ok {
+		return "", nil, fmt.Errorf("%s/%s: %w", repo, path, ErrNotFound)
+	}
+
+	return f.sha, append([]byte(nil), f.data...), nil
+}
+
+func (m *MemoryHost) Commit(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	parent := ""
+	if len(r.commits) > 0 {
+		parent = r.commits[len(r.commits)-1]
+	}
+
+	sha := r.commit(parent, message, files)
+	r.commits = append(r.commits, sha)
+
+	return sha, nil
+}
+
+func (m *MemoryHost) ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error) {
+	if err := requireManaged(ctx, m, repo); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	r.files = map[string]memoryFile{}
+	sha := r.commit("", message, files)
+	r.commits = []string{sha}
+
+	return sha, nil
+}
+
+func (m *MemoryHost) CommitBranch(ctx context.Context, repo, branch, message string, files []FileChange) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	parent := ""
+	if len(r.commits) > 0 {
+		parent = r.commits[len(r.commits)-1]
+	}
+
+	var tree strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&tree, "%s %s\n", gitHash("blob", f.Data), f.Path)
+	}
+
+	sha := gitHash("commit", []byte(fmt.Sprintf("parent %s\n%s\n%s", parent, tree.String(), message)))
+	r.branches[branch] = memoryBranch{sha: sha, files: append([]FileChange(nil), files...)}
+
+	return sha, nil
+}
+
+func (m *MemoryHost) OpenPullRequest(ctx context.Context, repo, branch, title, body string) (PullRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return PullRequest{}, err
+	}
+	if _, ok := r.branches[branch]; !ok {
+		return PullRequest{}, fmt.Errorf("branch %s: %w", branch, ErrNotFound)
+	}
+
+	for _, pr := range r.pulls {
+		if pr.Branch == branch {
+			return pr, nil
+		}
+	}
+
+	r.lastPull++
+	pr := PullRequest{
+		Number: r.lastPull,
+		URL:    fmt.Sprintf("%s/pull/%d", m.RepoURL(repo), r.lastPull),
+		Branch: branch,
+	}
+	r.pulls = append(r.pulls, pr)
+
+	return pr, nil
+}
+
+func (m *MemoryHost) MergePullRequest(ctx context.Context, repo string, pr PullRequest, message string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	b, ok := r.branches[pr.Branch]
+	if !ok {
+		return "", fmt.Errorf("branch %s: %w", pr.Branch, ErrNotFound)
+	}
+
+	parent := ""
+	if len(r.commits) > 0 {
+		parent = r.commits[len(r.commits)-1]
+	}
+
+	sha := r.commit(parent+" "+b.sha, message, b.files)
+	r.commits = append(r.commits, sha)
+	delete(r.branches, pr.Branch)
+
+	for i := range r.pulls {
+		if r.pulls[i].Number == pr.Number {
+			r.pulls = append(r.pulls[:i], r.pulls[i+1:]...)
+			break
+		}
+	}
+
+	return sha, nil
+}
+
+// commit writes files over the repo's current ones and returns the SHA of a
+// commit of them on top of parent.
+func (r *memoryRepo) commit(parent, message string, files []FileChange) string {
+	var tree strings.Builder
+	for _, f := range files {
+		data := append([]byte(nil), f.Data...)
+		sha := gitHash("blob", data)
+		r.files[f.Path] = memoryFile{sha: sha, data: data}
+		fmt.Fprintf(&tree, "%s %s\n", sha, f.Path)
+	}
+
+	return gitHash("commit", []byte(fmt.Sprintf("parent %s\n%s\n%s", parent, tree.String(), message)))
+}
+
+func (m *MemoryHost) LastCommit(ctx context.Context, repo string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	if len(r.commits) == 0 {
+		return "", fmt.Errorf("no commits found")
+	}
+
+	return r.commits[len(r.commits)-1], nil
+}
+
+func (m *MemoryHost) CreateRelease(ctx context.Context, repo string, rel Release) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(r.commits, rel.SHA) {
+		return fmt.Errorf("unknown_commit:%s", rel.SHA)
+	}
+
+	r.releases[rel.Tag] = rel
+	return nil
+}
+
+func (m *MemoryHost) SetupPages(ctx context.Context, repo string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return err
+	}
+
+	r.pages = true
+	return nil
+}
+
+func (m *MemoryHost) WaitForPages(ctx context.Context, repo, sha string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.repo(repo)
+	if err != nil {
+		return err
+	}
+
+	if !r.pages {
+		return fmt.Errorf("pages_not_enabled:%s", repo)
+	}
+	if len(r.commits) == 0 || r.commits[len(r.commits)-1] != sha {
+		return errPagesTimeout
+	}
+
+	return nil
+}
+
+func (m *MemoryHost) RepoURL(repo string) string {
+	return fmt.Sprintf("memory://%s/%s", m.Owner, repo)
+}
+
+func (m *MemoryHost) PagesURL(repo string) string {
+	return fmt.Sprintf("memory://%s/%s/pages/", m.Owner, repo)
+}
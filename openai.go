@@ -17,6 +17,10 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// errOpenAIEmptyResponse is an answer without choices, an upstream hiccup
+// that is retried like a 5xx.
+var errOpenAIEmptyResponse = errors.New("openai_empty_response")
+
 type VibeAttachement struct {
 	Filename string `yaml:"filename"`
 	URL      string `yaml:"url"`
@@ -36,7 +40,7 @@ type VibeResponse struct {
 
 var OpenAI openai.Client
 
-func InitOpenAI() error {
+func InitOpenAI(ctx context.Context) error {
 	if os.Getenv("OPENAI_KEY") == "" {
 		return fmt.Errorf("openai_key_missing")
 	}
@@ -45,7 +49,7 @@ func InitOpenAI() error {
 		option.WithAPIKey(os.Getenv("OPENAI_KEY")),
 	)
 
-	_, err := OpenAI.Models.List(context.Background())
+	_, err := OpenAI.Models.List(ctx)
 	if err != nil {
 		return fmt.Errorf("openai_key_invalid: %w", err)
 	}
@@ -152,8 +156,8 @@ func extractRawYAML(s string) string {
 	return strings.TrimSpace(s)
 }
 
-func GenerateFrontend(vr VibeRequest) (*[]VibeResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+func GenerateFrontend(ctx context.Context, vr VibeRequest) (*[]VibeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
 	attachmentsYAML, err := yaml.Marshal(vr.Attachements)
@@ -213,51 +217,15 @@ OUTPUT FORMAT (strict):
 		vr.Prompt, vr.Checks, string(attachmentsYAML),
 	)
 
-	resp, err := OpenAI.Chat.Completions.New(
-		ctx,
-		openai.ChatCompletionNewParams{
-			Model: "gpt-5-mini",
-			Messages: []openai.ChatCompletionMessageParamUnion{
-				{
-					OfSystem: &openai.ChatCompletionSystemMessageParam{
-						Content: openai.ChatCompletionSystemMessageParamContentUnion{
-							OfString: openai.String(sys),
-						},
-					},
-				},
-				{
-					OfUser: &openai.ChatCompletionUserMessageParam{
-						Content: openai.ChatCompletionUserMessageParamContentUnion{
-							OfString: openai.String(userPrompt),
-						},
-					},
-				},
-			},
-		},
-		option.WithRequestTimeout(320*time.Second),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("openai_error: %w", err)
-	}
-
-	raw := resp.Choices[0].Message.Content
-	clean := extractRawYAML(raw)
-
-	var parsed []VibeResponse
-	if err := yaml.Unmarshal([]byte(clean), &parsed); err != nil {
-		log.Printf("yaml unmarshal error: %v; content:\n%s", err, raw)
-		return nil, fmt.Errorf("failed_to_parse_yaml: %w", err)
-	}
-
-	return &parsed, nil
+	return completeBundle(ctx, sys, userPrompt)
 }
 
-func ModifyFrontend(vr VibeRequest, existing []VibeResponse) (*[]VibeResponse, error) {
-	if err := InitOpenAI(); err != nil {
+func ModifyFrontend(ctx context.Context, vr VibeRequest, existing []VibeResponse) (*[]VibeResponse, error) {
+	if err := InitOpenAI(ctx); err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
 	attachmentsYAML, err := yaml.Marshal(vr.Attachements)
@@ -307,6 +275,90 @@ Please return YAML with exactly two objects (README.md markdown, index.html html
 		string(attachmentsYAML),
 	)
 
+	return completeBundle(ctx, sys, userPrompt)
+}
+
+// GenerateFromTemplate is GenerateFrontend for a repo started from a
+// template: the model writes README.md and index.html on top of the
+// scaffold, which it is shown (shown) or told about (listed) and may build
+// on, but not change.
+func GenerateFromTemplate(ctx context.Context, vr VibeRequest, description string, shown []VibeResponse, listed []string) (*[]VibeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	attachmentsYAML, err := yaml.Marshal(vr.Attachements)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attachments to yaml: %w", err)
+	}
+	scaffoldYAML, err := yaml.Marshal(shown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal template files to yaml: %w", err)
+	}
+	listedYAML, err := yaml.Marshal(listed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal template file list to yaml: %w", err)
+	}
+
+	sys := `You are a developer who builds a project on top of an existing template scaffold. Output exactly TWO files as a YAML array of objects:
+- type: "markdown" | "html"
+- filename: string
+- content: string
+Files required (exactly these two):
+1) README.md (type: markdown)
+2) index.html (type: html)
+
+NON-NEGOTIABLE BEHAVIOR:
+- Build on the scaffold: keep its structure, styles and scripts, and link its files by their exact paths. If the scaffold has README.md or index.html, fill in or modify them rather than starting over.
+- Every other scaffold file is committed unchanged; never return it, and never reference files that are neither in the scaffold nor in the attachments list.
+- DO NOT ASSUME. Derive everything from the user prompt, the provided checks, the scaffold and the attachments list (filenames+URLs).
+- If required info is missing/ambiguous, implement a graceful runtime error path in the HTML (visible message) and log a clear console error; do NOT fabricate data, fields, URLs, or formats.
+- Only use public CDNs for any libs not in the scaffold (e.g., jsDelivr/unpkg/cdnjs) AND DO NOT use integrity hashes at ALL.
+- Validate presence of required DOM elements before writing into them; fail gracefully if missing.
+
+OUTPUT RULES:
+- Return a YAML array with exactly two objects (README.md, index.html), each having only: type, filename, content.
+- No extra keys, comments, prose, or backticks.`
+
+	userPrompt := fmt.Sprintf(
+		`TEMPLATE:
+%q
+
+TEMPLATE FILES (authoritative, committed as they are):
+---
+%s
+---
+
+OTHER TEMPLATE FILES (binary or too large to show; committed as they are):
+---
+%s
+---
+
+TASK:
+%q
+
+EVALUATION CHECKS (must design for these; do not assume anything not stated):
+%q
+
+ATTACHMENTS (authoritative list; only use these if needed):
+---
+%s
+---
+
+OUTPUT FORMAT (strict):
+- YAML array with exactly two items:
+  - README.md (type: markdown) — professional, how to open locally, mention MIT license with a link to LICENSE (do not include LICENSE file).
+  - index.html (type: html) — the full working page, built on the template.
+- No extra keys, comments, or backticks.`,
+		description, string(scaffoldYAML), string(listedYAML),
+		vr.Prompt, vr.Checks, string(attachmentsYAML),
+	)
+
+	return completeBundle(ctx, sys, userPrompt)
+}
+
+// completeBundle sends the prompts to the model and parses the YAML array of
+// files it answers with.
+func completeBundle(ctx context.Context, sys, userPrompt string) (*[]VibeResponse, error) {
 	resp, err := OpenAI.Chat.Completions.New(
 		ctx,
 		openai.ChatCompletionNewParams{
@@ -334,6 +386,10 @@ Please return YAML with exactly two objects (README.md markdown, index.html html
 		return nil, fmt.Errorf("openai_error: %w", err)
 	}
 
+	if len(resp.Choices) == 0 {
+		return nil, errOpenAIEmptyResponse
+	}
+
 	raw := resp.Choices[0].Message.Content
 	clean := extractRawYAML(raw)
 
@@ -342,5 +398,6 @@ Please return YAML with exactly two objects (README.md markdown, index.html html
 		log.Printf("yaml unmarshal error: %v; content:\n%s", err, raw)
 		return nil, fmt.Errorf("failed_to_parse_yaml: %w", err)
 	}
+
 	return &parsed, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PagesConfig controls how long rounds wait for a site: Timeout bounds the
+// build or deployment, Interval is how often it is polled between webhook
+// events, and VerifyTimeout bounds waiting for the live site to serve the
+// new build stamp.
+type PagesConfig struct {
+	Timeout       time.Duration
+	Interval      time.Duration
+	VerifyTimeout time.Duration
+}
+
+func LoadPagesConfig() PagesConfig {
+	return PagesConfig{
+		Timeout:       EnvDuration("PAGES_TIMEOUT", 3*time.Minute),
+		Interval:      EnvDuration("PAGES_POLL_INTERVAL", 5*time.Second),
+		VerifyTimeout: EnvDuration("PAGES_VERIFY_TIMEOUT", 2*time.Minute),
+	}
+}
+
+var errPagesTimeout = errors.New("pages_build_timeout")
+
+// pagesEvents fans webhook notifications about a repo's site out to the
+// rounds waiting on it, so they can check right away instead of at the next
+// poll.
+type pagesEvents struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]bool
+}
+
+// PagesEvents receives page_build and deployment_status webhooks.
+var PagesEvents = &pagesEvents{subs: map[string]map[chan struct{}]bool{}}
+
+// Subscribe returns a channel that receives a value whenever repo
+// ("owner/name") has news, and a function to stop listening.
+func (e *pagesEvents) Subscribe(repo string) (<-chan struct{}, func()) {
+	key := strings.ToLower(repo)
+	ch := make(chan struct{}, 1)
+
+	e.mu.Lock()
+	if e.subs[key] == nil {
+		e.subs[key] = map[chan struct{}]bool{}
+	}
+	e.subs[key][ch] = true
+	e.mu.Unlock()
+
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.subs[key], ch)
+		if len(e.subs[key]) == 0 {
+			delete(e.subs, key)
+		}
+	}
+}
+
+func (e *pagesEvents) Notify(repo string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subs[strings.ToLower(repo)] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitPagesEvent blocks until an event arrives, interval passes or ctx is
+// done, in which case it returns the context's cause.
+func waitPagesEvent(ctx context.Context, events <-chan struct{}, interval time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-events:
+		return nil
+	case <-timer.C:
+		return nil
+	}
+}
+
+// VerifyWebhookSignature checks GitHub's X-Hub-Signature-256 header against
+// the body signed with secret.
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	got, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(got), []byte(want))
+}
+
+// buildStampName is the <meta> that carries the build stamp in index.html.
+const buildStampName = "sdt-build"
+
+var buildStampPattern = regexp.MustCompile(`(?i)<meta\s+name="` + buildStampName + `"[^>]*>\s*`)
+var headPattern = regexp.MustCompile(`(?i)<head[^>]*>`)
+
+// BuildStamp identifies the build a round publishes, so the live site can be
+// checked for it. It is known before the commit exists, unlike its SHA.
+func BuildStamp(req UserRequest) string {
+	return fmt.Sprintf("%s-round-%d", requestHash(req)[:12], req.Round)
+}
+
+func buildStampTag(stamp string) string {
+	return fmt.Sprintf(`<meta name="%s" content="%s">`, buildStampName, html.EscapeString(stamp))
+}
+
+// StampIndex puts the build stamp into an index.html, replacing any stamp
+// from an earlier round. It goes right after <head>, or at the very start of
+// a page without one.
+func StampIndex(page []byte, stamp string) []byte {
+	s := buildStampPattern.ReplaceAllString(string(page), "")
+	tag := buildStampTag(stamp)
+
+	if loc := headPattern.FindStringIndex(s); loc != nil {
+		return []byte(s[:loc[1]] + "\n" + tag + s[loc[1]:])
+	}
+	return []byte(tag + "\n" + s)
+}
+
+// stampFiles stamps the index.html among files, if there is one.
+func stampFiles(files []FileChange, stamp string) {
+	for i := range files {
+		if files[i].Path == "index.html" {
+			files[i].Data = StampIndex(files[i].Data, stamp)
+		}
+	}
+}
+
+// VerifyPages polls the live site until it serves the page carrying stamp.
+// Sites that aren't on http(s), like the memory host's, are taken as is.
+func VerifyPages(ctx context.Context, pagesURL, stamp string, cfg PagesConfig) error {
+	u, err := url.Parse(pagesURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+
+	// A query the CDN hasn't seen gets past any cached copy.
+	q := u.Query()
+	q.Set("sdt", stamp)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.VerifyTimeout, fmt.Errorf("pages_verify_timeout:%s", stamp))
+	defer cancel()
+
+	tag := buildStampTag(stamp)
+	for {
+		body, err := HTTPGetClient(ctx, u.String(), map[string]string{"Cache-Control": "no-cache"})
+		if err == nil && strings.Contains(string(body), tag) {
+			return nil
+		}
+
+		if err := Sleep(ctx, cfg.Interval); err != nil {
+			return context.Cause(ctx)
+		}
+	}
+}
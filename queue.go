@@ -6,72 +6,830 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
 type Job struct {
-	Req UserRequest
-	// You can add metadata here (receivedAt, attempt, etc.)
+	ID         string      `json:"id"`
+	Req        UserRequest `json:"req"`
+	ReceivedAt time.Time   `json:"received_at"`
+	Attempt    int         `json:"attempt"`
+	// Priority orders jobs across tasks (higher runs first); among equal
+	// priorities the earliest Deadline goes first. NotBefore holds the job
+	// back until that time.
+	Priority  int        `json:"priority,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
 }
 
+func (j Job) Overdue(now time.Time) bool {
+	return j.Deadline != nil && now.After(*j.Deadline)
+}
+
+// ReportFunc lets a round record that it reached a stage. eval carries the
+// repo/pages URLs and commit SHA known so far.
+type ReportFunc func(stage string, eval EvaluatorRequest)
+
+func NewJob(req UserRequest) Job {
+	return Job{
+		ID:         GenerateUUID(),
+		Req:        req,
+		ReceivedAt: time.Now(),
+		Priority:   req.Priority,
+		Deadline:   req.Deadline,
+		NotBefore:  req.NotBefore,
+	}
+}
+
+// queueEntry is a job waiting to run. seq preserves arrival order, and a
+// retried job keeps its seq so later jobs for the same task stay behind it.
+// slot is set when the job holds one of the queue's capacity slots, which
+// replayed jobs over capacity don't.
+type queueEntry struct {
+	job     Job
+	seq     uint64
+	readyAt time.Time
+	slot    bool
+}
+
+// before reports whether e should be dispatched ahead of o: higher priority
+// first, then earliest deadline (jobs without one last), then arrival order.
+func (e queueEntry) before(o queueEntry) bool {
+	if e.job.Priority != o.job.Priority {
+		return e.job.Priority > o.job.Priority
+	}
+
+	ed, od := e.job.Deadline, o.job.Deadline
+	switch {
+	case ed != nil && od == nil:
+		return true
+	case ed == nil && od != nil:
+		return false
+	case ed != nil && od != nil && !ed.Equal(*od):
+		return ed.Before(*od)
+	}
+
+	return e.seq < o.seq
+}
+
+type runningJob struct {
+	job    Job
+	cancel context.CancelCauseFunc
+	// stage and since track progress for the watchdog; flagged is set once
+	// the current stage has been reported as over budget.
+	stage   string
+	since   time.Time
+	flagged bool
+}
+
+// PanicError is a panic recovered from a round, with the stack at the point
+// it happened.
+type PanicError struct {
+	Value any
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+func runRecovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: string(debug.Stack())}
+		}
+	}()
+
+	return fn()
+}
+
+// QueueConfig holds the queue settings read from the environment.
+type QueueConfig struct {
+	Size             int
+	Workers          int
+	Timeout          time.Duration
+	Retry            map[ErrorClass]RetryPolicy
+	StageBudgets     map[string]time.Duration
+	WatchdogInterval time.Duration
+}
+
+func LoadQueueConfig() QueueConfig {
+	return QueueConfig{
+		Size:             EnvInt("QUEUE_SIZE", 100),
+		Workers:          EnvInt("QUEUE_WORKERS", 3),
+		Timeout:          EnvDuration("JOB_TIMEOUT", 15*time.Minute),
+		Retry:            LoadRetryPolicies(),
+		StageBudgets:     LoadStageBudgets(),
+		WatchdogInterval: EnvDuration("WATCHDOG_INTERVAL", 30*time.Second),
+	}
+}
+
+// MaxWorkers bounds Resize so a typo can't spawn thousands of goroutines.
+const MaxWorkers = 64
+
+// Queue runs jobs on a pool of workers that can be resized at runtime. Jobs
+// that share a Task run one at a time in arrival order; jobs for different
+// tasks run in parallel.
 type Queue struct {
-	ch      chan Job
-	workers int
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []queueEntry
+	active   map[string]bool
+	running  map[string]*runningJob
+	draining bool
+	wg       sync.WaitGroup
+	seq      uint64
+	wakeAt   time.Time
+	slots    chan struct{}
+	workers  int
+	live     int
+	workerID int
+	ctx      context.Context
+	timeout  time.Duration
+	store    *JobStore
+	policies map[ErrorClass]RetryPolicy
+	budgets  map[string]time.Duration
+	interval time.Duration
+	throttle func(job Job, now time.Time) time.Time
+	// process runs a job's round; it is ProcessRequest outside of tests.
+	process func(ctx context.Context, req UserRequest, report ReportFunc) error
 }
 
-func NewQueue(size, workers int) *Queue {
-	return &Queue{
-		ch:      make(chan Job, size),
-		workers: workers,
+// errJobCanceled is the cancellation cause for jobs stopped through Cancel,
+// so they can be told apart from timeouts and shutdown.
+var errJobCanceled = errors.New("job_canceled")
+
+var errQueueDraining = errors.New("queue_draining")
+
+type QueueStats struct {
+	Capacity int `json:"capacity"`
+	Len      int `json:"len"`
+	Running  int `json:"running"`
+	Workers  int `json:"workers"`
+	Live     int `json:"live_workers"`
+	Overdue  int `json:"overdue"`
+	Stuck    int `json:"stuck"`
+	// Paused counts waiting jobs held back by Throttle; PausedUntil is when
+	// the first of them may start.
+	Paused      int        `json:"paused"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+func NewQueue(cfg QueueConfig, store *JobStore) *Queue {
+	q := &Queue{
+		active:   map[string]bool{},
+		running:  map[string]*runningJob{},
+		slots:    make(chan struct{}, cfg.Size),
+		workers:  cfg.Workers,
+		timeout:  cfg.Timeout,
+		store:    store,
+		policies: cfg.Retry,
+		budgets:  cfg.StageBudgets,
+		interval: cfg.WatchdogInterval,
+		process:  ProcessRequest,
 	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
 }
 
 func (q *Queue) Start(ctx context.Context) {
-	for i := 0; i < q.workers; i++ {
-		go func(id int) {
-			log.Printf("[worker %d] started", id)
-			for {
-				select {
-				case <-ctx.Done():
-					log.Printf("[worker %d] stopping", id)
-					return
-				case job := <-q.ch:
-					processJob(ctx, job)
-				}
+	// Jobs left over from a previous run go back in the order they arrived.
+	// They were admitted before, so they may exceed capacity briefly; those
+	// that don't fit hold no slot, and finishing them frees none.
+	pending := q.store.Pending()
+	if len(pending) > 0 {
+		log.Printf("replaying %d pending job(s) from disk", len(pending))
+	}
+	for _, rec := range pending {
+		job, err := q.store.LoadJob(rec)
+		if err != nil {
+			log.Printf("job_failed: %s: %v", rec.Job.ID, err)
+			q.update(rec.Job.ID, func(rec *JobRecord) {
+				rec.State = JobFailed
+				rec.LastError = err.Error()
+				rec.ErrorClass = ClassifyError(err)
+				rec.NextAttempt = nil
+				rec.AddStage(string(JobFailed))
+			})
+			continue
+		}
+
+		slot := true
+		select {
+		case q.slots <- struct{}{}:
+		default:
+			slot = false
+		}
+
+		var readyAt time.Time
+		if rec.State == JobRetrying && rec.NextAttempt != nil {
+			readyAt = *rec.NextAttempt
+		}
+		q.push(job, readyAt, slot)
+	}
+
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+
+	if q.interval > 0 {
+		go q.watch(ctx, q.budgets, q.interval)
+	}
+
+	q.mu.Lock()
+	q.ctx = ctx
+	q.spawn()
+	q.mu.Unlock()
+}
+
+// spawn starts workers until there are as many as configured. Caller holds
+// q.mu.
+func (q *Queue) spawn() {
+	for q.live < q.workers {
+		q.live++
+		q.workerID++
+		q.wg.Add(1)
+
+		go q.work(q.workerID)
+	}
+}
+
+// work is a worker's loop. Panics inside a round are turned into job
+// failures by processJob; anything that escapes past that is recovered here
+// and the worker is restarted under the same ID.
+func (q *Queue) work(id int) {
+	var current *queueEntry
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			q.wg.Done()
+			return
+		}
+
+		log.Printf("[worker %d] panic: %v\n%s", id, r, debug.Stack())
+
+		if current != nil {
+			q.done(*current, time.Time{}, false)
+		}
+
+		// Hand over to a fresh goroutine before releasing this one so Wait
+		// never sees the pool at zero.
+		q.wg.Add(1)
+		go q.work(id)
+		q.wg.Done()
+	}()
+
+	log.Printf("[worker %d] started", id)
+	for {
+		entry, jobCtx, ok := q.next(q.ctx)
+		if !ok {
+			log.Printf("[worker %d] stopping", id)
+			return
+		}
+
+		current = &entry
+		retryAt, retry := q.processJob(jobCtx, entry.job)
+		current = nil
+		q.done(entry, retryAt, retry)
+	}
+}
+
+// Resize changes the number of workers. Growing starts workers right away;
+// when shrinking, idle workers exit now and busy ones after their current
+// job.
+func (q *Queue) Resize(workers int) error {
+	if workers < 0 || workers > MaxWorkers {
+		return fmt.Errorf("invalid_worker_count:%d (0-%d)", workers, MaxWorkers)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	log.Printf("resizing worker pool from %d to %d", q.workers, workers)
+	q.workers = workers
+	if q.ctx != nil {
+		q.spawn()
+	}
+	q.cond.Broadcast()
+
+	return nil
+}
+
+// Throttle makes workers hold off starting a job until the time fn returns
+// for it; a zero or past time lets it through. Other jobs are dispatched in
+// the meantime, and running jobs are not affected.
+func (q *Queue) Throttle(fn func(job Job, now time.Time) time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.throttle = fn
+	q.cond.Broadcast()
+}
+
+// pausedUntil returns when job may be dispatched, or the zero time if it
+// isn't held back. Caller holds q.mu.
+func (q *Queue) pausedUntil(job Job, now time.Time) time.Time {
+	if q.throttle == nil {
+		return time.Time{}
+	}
+	if until := q.throttle(job, now); until.After(now) {
+		return until
+	}
+	return time.Time{}
+}
+
+// Drain stops workers from picking up new jobs and waits up to grace for
+// running ones to finish. It reports whether everything finished in time;
+// jobs still running after that are checkpointed once the context passed to
+// Start is cancelled.
+func (q *Queue) Drain(grace time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.draining = true
+	q.cond.Broadcast()
+
+	deadline := time.Now().Add(grace)
+	timer := time.AfterFunc(grace, func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for len(q.running) > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		q.cond.Wait()
+	}
+
+	return true
+}
+
+func (q *Queue) Draining() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.draining
+}
+
+// Wait blocks until all workers have exited or timeout passes.
+func (q *Queue) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	overdue := 0
+	paused := 0
+	var pausedUntil time.Time
+	for _, e := range q.pending {
+		if e.job.Overdue(now) {
+			overdue++
+		}
+		if until := q.pausedUntil(e.job, now); !until.IsZero() {
+			paused++
+			if pausedUntil.IsZero() || until.Before(pausedUntil) {
+				pausedUntil = until
 			}
-		}(i + 1)
+		}
+	}
+	stuck := 0
+	for _, r := range q.running {
+		if r.job.Overdue(now) {
+			overdue++
+		}
+		if r.flagged {
+			stuck++
+		}
+	}
+
+	stats := QueueStats{
+		Capacity: cap(q.slots),
+		Len:      len(q.pending),
+		Running:  len(q.active),
+		Workers:  q.workers,
+		Live:     q.live,
+		Overdue:  overdue,
+		Stuck:    stuck,
+		Paused:   paused,
+	}
+	if !pausedUntil.IsZero() {
+		stats.PausedUntil = &pausedUntil
 	}
+
+	return stats
 }
 
-func (q *Queue) TryEnqueue(job Job, timeout time.Duration) error {
+// TryEnqueue only reports success once the job has been written to disk. If
+// the same request (email, task, round, nonce) was already received, nothing
+// is queued and the existing record is returned with created set to false.
+// The slot is taken before the job is recorded, so a request is never
+// answered as a duplicate of a job that then fails to get in.
+func (q *Queue) TryEnqueue(job Job, timeout time.Duration) (JobRecord, bool, error) {
+	rec := JobRecord{Job: job, State: JobQueued}
+	rec.AddStage("queued")
+
+	if q.Draining() {
+		return JobRecord{}, false, errQueueDraining
+	}
+
+	if err := q.acquire(timeout); err != nil {
+		return JobRecord{}, false, err
+	}
+
+	rec, created, err := q.store.Insert(rec)
+	if err != nil || !created {
+		q.release()
+		return rec, created, err
+	}
+
+	q.push(job, time.Time{}, true)
+	return rec, true, nil
+}
+
+// Requeue moves a job off the dead-letter list and gives it a fresh set of
+// attempts.
+func (q *Queue) Requeue(id string, timeout time.Duration) (JobRecord, error) {
+	rec, ok := q.store.Get(id)
+	if !ok {
+		return JobRecord{}, fmt.Errorf("job_not_found:%s", id)
+	}
+	if rec.State != JobFailed {
+		return JobRecord{}, fmt.Errorf("job_not_dead_lettered:%s", rec.State)
+	}
+
+	job, err := q.store.LoadJob(rec)
+	if err != nil {
+		return JobRecord{}, err
+	}
+
+	if err := q.acquire(timeout); err != nil {
+		return JobRecord{}, err
+	}
+
+	rec, err = q.store.Update(id, func(rec *JobRecord) {
+		rec.State = JobQueued
+		rec.Job.Attempt = 0
+		rec.NextAttempt = nil
+		rec.Stack = ""
+		rec.AddStage("requeued")
+	})
+	if err != nil {
+		q.release()
+		return JobRecord{}, err
+	}
+
+	job.Attempt = rec.Job.Attempt
+	q.push(job, time.Time{}, true)
+	return rec, nil
+}
+
+// Cancel stops a running job or removes a queued one. Finished jobs can't be
+// cancelled.
+func (q *Queue) Cancel(id string) (JobRecord, error) {
+	q.mu.Lock()
+
+	if r, ok := q.running[id]; ok {
+		r.cancel(errJobCanceled)
+		q.mu.Unlock()
+
+		// The worker records the final state once the round has unwound.
+		rec, _ := q.store.Get(id)
+		return rec, nil
+	}
+
+	for i, e := range q.pending {
+		if e.job.ID != id {
+			continue
+		}
+
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		if e.slot {
+			q.release()
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		return q.store.Update(id, func(rec *JobRecord) {
+			rec.State = JobCanceled
+			rec.NextAttempt = nil
+			rec.AddStage(string(JobCanceled))
+		})
+	}
+
+	q.mu.Unlock()
+
+	rec, ok := q.store.Get(id)
+	if !ok {
+		return JobRecord{}, fmt.Errorf("job_not_found:%s", id)
+	}
+	return JobRecord{}, fmt.Errorf("job_not_cancelable:%s", rec.State)
+}
+
+func (q *Queue) acquire(timeout time.Duration) error {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 	select {
-	case q.ch <- job:
+	case q.slots <- struct{}{}:
 		return nil
 	case <-timer.C:
 		return errors.New("queue_full_or_slow")
 	}
 }
 
-func ProcessRequest(req UserRequest) error {
+func (q *Queue) release() {
+	select {
+	case <-q.slots:
+	default:
+	}
+}
+
+func (q *Queue) push(job Job, readyAt time.Time, slot bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.NotBefore != nil && job.NotBefore.After(readyAt) {
+		readyAt = *job.NotBefore
+	}
+
+	q.seq++
+	q.insert(queueEntry{job: job, seq: q.seq, readyAt: readyAt, slot: slot})
+}
+
+// insert keeps pending sorted by seq. Caller holds q.mu.
+func (q *Queue) insert(e queueEntry) {
+	i := len(q.pending)
+	for i > 0 && q.pending[i-1].seq > e.seq {
+		i--
+	}
+	q.pending = append(q.pending, queueEntry{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = e
+	q.cond.Broadcast()
+}
+
+// next blocks until a job can run or ctx is done. A job can run when no
+// other job for its task is running or waiting ahead of it; of those, the
+// best one by priority and deadline is picked. Jobs held back by the
+// throttle wait like jobs in backoff. The returned context is cancelled by
+// Cancel.
+func (q *Queue) next(ctx context.Context) (queueEntry, context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if ctx.Err() != nil || q.draining {
+			q.live--
+			return queueEntry{}, nil, false
+		}
+
+		if q.live > q.workers {
+			q.live--
+			return queueEntry{}, nil, false
+		}
+
+		now := time.Now()
+		seen := map[string]bool{}
+		best := -1
+		var wake time.Time
+
+		for i, e := range q.pending {
+			// Only the oldest job of each task is a candidate.
+			task := e.job.Req.Task
+			if q.active[task] || seen[task] {
+				continue
+			}
+			seen[task] = true
+
+			readyAt := e.readyAt
+			if until := q.pausedUntil(e.job, now); until.After(readyAt) {
+				readyAt = until
+			}
+			if readyAt.After(now) {
+				if wake.IsZero() || readyAt.Before(wake) {
+					wake = readyAt
+				}
+				continue
+			}
+
+			if best < 0 || e.before(q.pending[best]) {
+				best = i
+			}
+		}
+
+		if best >= 0 {
+			e := q.pending[best]
+			q.pending = append(q.pending[:best], q.pending[best+1:]...)
+			q.active[e.job.Req.Task] = true
+
+			jobCtx, cancel := context.WithCancelCause(ctx)
+			q.running[e.job.ID] = &runningJob{job: e.job, cancel: cancel, stage: "running", since: now}
+			return e, jobCtx, true
+		}
+
+		q.scheduleWake(wake)
+		q.cond.Wait()
+	}
+}
+
+// scheduleWake makes sure waiting workers get woken when the earliest
+// backoff or not_before time passes. Caller holds q.mu.
+func (q *Queue) scheduleWake(at time.Time) {
+	if at.IsZero() || (!q.wakeAt.IsZero() && !at.Before(q.wakeAt)) {
+		return
+	}
+
+	q.wakeAt = at
+	time.AfterFunc(time.Until(at), func() {
+		q.mu.Lock()
+		q.wakeAt = time.Time{}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+}
+
+// done frees the job's task lane, putting the job back in its place if it is
+// going to be retried.
+func (q *Queue) done(e queueEntry, retryAt time.Time, retry bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.active, e.job.Req.Task)
+	if r, ok := q.running[e.job.ID]; ok {
+		r.cancel(nil)
+		delete(q.running, e.job.ID)
+	}
+
+	if retry {
+		e.job.Attempt++
+		e.readyAt = retryAt
+		q.insert(e)
+		return
+	}
+
+	if e.slot {
+		q.release()
+	}
+	q.cond.Broadcast()
+}
+
+func ProcessRequest(ctx context.Context, req UserRequest, report ReportFunc) error {
+	host := HostFor(Host, Owners, req)
+
 	switch req.Round {
 	case 1:
-		return Round1(req)
+		return Round1(ctx, host, req, report)
 	case 2:
-		return Round2(req)
+		return Round2(ctx, host, req, report)
 	default:
 		return fmt.Errorf("unsupported_round:%d", req.Round)
 	}
 }
 
-func processJob(ctx context.Context, job Job) {
-	_, cancel := context.WithTimeout(ctx, 5*time.Minute)
+// processJob runs one attempt of the job and reports whether, and when, it
+// should be retried.
+func (q *Queue) processJob(ctx context.Context, job Job) (time.Time, bool) {
+	jobCtx, cancel := context.WithTimeout(ctx, q.timeout)
 	defer cancel()
 
-	err := ProcessRequest(job.Req)
-	if err != nil {
-		log.Printf("job_failed: %v", err)
-		return
+	job.Attempt++
+	q.update(job.ID, func(rec *JobRecord) {
+		rec.Job.Attempt = job.Attempt
+		rec.State = JobRunning
+		rec.StuckStage = ""
+		rec.AddStage("running")
+	})
+
+	var last EvaluatorRequest
+	report := func(stage string, eval EvaluatorRequest) {
+		last = eval
+		q.enterStage(job.ID, stage)
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.AddStage(stage)
+			rec.StuckStage = ""
+			rec.RepoURL = eval.RepoURL
+			rec.PagesURL = eval.PagesURL
+			rec.CommitSHA = eval.CommitSHA
+		})
+	}
+
+	err := runRecovered(func() error {
+		return q.process(jobCtx, job.Req, report)
+	})
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		log.Printf("job_panicked: %s: attempt %d: %v\n%s", job.ID, job.Attempt, panicErr.Value, panicErr.Stack)
+
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.State = JobFailed
+			rec.LastError = err.Error()
+			rec.ErrorClass = ErrPermanent
+			rec.Stack = panicErr.Stack
+			rec.NextAttempt = nil
+			rec.AddStage(string(JobFailed))
+		})
+		return time.Time{}, false
+	}
+
+	if err == nil {
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.State = JobSucceeded
+			rec.LastError = ""
+			rec.ErrorClass = ""
+			rec.Stack = ""
+			rec.StuckStage = ""
+			rec.Result = &last
+			rec.AddStage(string(JobSucceeded))
+		})
+		return time.Time{}, false
+	}
+
+	if errors.Is(context.Cause(ctx), errJobCanceled) {
+		log.Printf("job_canceled: %s: attempt %d: %v", job.ID, job.Attempt, err)
+
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.State = JobCanceled
+			rec.LastError = err.Error()
+			rec.AddStage(string(JobCanceled))
+		})
+		return time.Time{}, false
+	}
+
+	if ctx.Err() != nil {
+		// Shutting down: checkpoint the job so it is replayed on the next
+		// start. The interrupted attempt doesn't count against its retries.
+		log.Printf("job_interrupted: %s: attempt %d: %v", job.ID, job.Attempt, err)
+
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.State = JobQueued
+			rec.Job.Attempt = job.Attempt - 1
+			rec.LastError = "interrupted_by_shutdown: " + err.Error()
+			rec.AddStage("checkpointed")
+		})
+		return time.Time{}, false
+	}
+
+	class := ClassifyError(err)
+	policy := q.policies[class]
+
+	if job.Attempt < policy.MaxAttempts {
+		wait := policy.Backoff(job.Attempt)
+		if d, ok := retryAfter(err); ok && d > wait {
+			wait = d
+		}
+
+		next := time.Now().Add(wait)
+		log.Printf("job_failed: %s: attempt %d (%s), retrying at %s: %v",
+			job.ID, job.Attempt, class, next.Format(time.RFC3339), err)
+
+		q.update(job.ID, func(rec *JobRecord) {
+			rec.State = JobRetrying
+			rec.LastError = err.Error()
+			rec.ErrorClass = class
+			rec.NextAttempt = &next
+			rec.AddStage(string(JobRetrying))
+		})
+		return next, true
+	}
+
+	log.Printf("job_failed: %s: attempt %d (%s), moved to dead-letter list: %v",
+		job.ID, job.Attempt, class, err)
+
+	q.update(job.ID, func(rec *JobRecord) {
+		rec.State = JobFailed
+		rec.LastError = err.Error()
+		rec.ErrorClass = class
+		rec.NextAttempt = nil
+		rec.AddStage(string(JobFailed))
+	})
+	return time.Time{}, false
+}
+
+func (q *Queue) update(id string, fn func(*JobRecord)) {
+	if _, err := q.store.Update(id, fn); err != nil {
+		log.Printf("job_store: %v", err)
 	}
 }
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestQueue starts a queue on a fresh store whose jobs are run by
+// process instead of a round.
+func newTestQueue(t *testing.T, workers int, process func(ctx context.Context, req UserRequest, report ReportFunc) error) *Queue {
+	t.Helper()
+
+	store, err := OpenJobStore(t.TempDir(), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQueue(QueueConfig{
+		Size:    20,
+		Workers: workers,
+		Timeout: 10 * time.Second,
+		Retry: map[ErrorClass]RetryPolicy{
+			ErrTransient:   {MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+			ErrRateLimited: {MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+			ErrPermanent:   {MaxAttempts: 1},
+		},
+	}, store)
+	q.process = process
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+
+	t.Cleanup(func() {
+		cancel()
+		q.Wait(5 * time.Second)
+		store.Close()
+	})
+	return q
+}
+
+var testNonce atomic.Int64
+
+func enqueue(t *testing.T, q *Queue, task string, edit func(*Job)) Job {
+	t.Helper()
+
+	job := NewJob(UserRequest{
+		Email: "student@example.com",
+		Task:  task,
+		Round: 1,
+		Nonce: fmt.Sprint(testNonce.Add(1)),
+	})
+	if edit != nil {
+		edit(&job)
+	}
+
+	if _, created, err := q.TryEnqueue(job, time.Second); err != nil || !created {
+		t.Fatalf("TryEnqueue = %v, %v", created, err)
+	}
+	return job
+}
+
+// waitState waits for the job to reach state and returns its record.
+func waitState(t *testing.T, q *Queue, id string, state JobState) JobRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, ok := q.store.Get(id)
+		if ok && rec.State == state {
+			return rec
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, rec.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// runLog records the order jobs ran in, by task.
+type runLog struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (l *runLog) add(task string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order = append(l.order, task)
+}
+
+func (l *runLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.order...)
+}
+
+func TestQueueRunsJobsOfATaskInOrder(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	overlap := false
+	ran := &runLog{}
+
+	q := newTestQueue(t, 4, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		mu.Lock()
+		running[req.Task]++
+		if running[req.Task] > 1 {
+			overlap = true
+		}
+		mu.Unlock()
+
+		ran.add(req.Task + "/" + req.Nonce)
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[req.Task]--
+		mu.Unlock()
+		return nil
+	})
+
+	var jobs []Job
+	for i := 0; i < 4; i++ {
+		jobs = append(jobs, enqueue(t, q, "same-task", nil))
+	}
+	other := enqueue(t, q, "other-task", nil)
+
+	for _, job := range append(jobs, other) {
+		waitState(t, q, job.ID, JobSucceeded)
+	}
+
+	if overlap {
+		t.Fatal("two jobs of one task ran at the same time")
+	}
+
+	var sameTask []string
+	for _, run := range ran.get() {
+		if strings.HasPrefix(run, "same-task/") {
+			sameTask = append(sameTask, run)
+		}
+	}
+	for i, job := range jobs {
+		if want := "same-task/" + job.Req.Nonce; sameTask[i] != want {
+			t.Fatalf("same-task ran %v, want arrival order", sameTask)
+		}
+	}
+}
+
+func TestQueueDispatchesByPriorityThenDeadline(t *testing.T) {
+	ran := &runLog{}
+	release := make(chan struct{})
+
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		if req.Task == "blocker" {
+			<-release
+			return nil
+		}
+		ran.add(req.Task)
+		return nil
+	})
+
+	// The only worker is busy while the rest queue up behind it.
+	blocker := enqueue(t, q, "blocker", nil)
+	waitState(t, q, blocker.ID, JobRunning)
+
+	soon := time.Now().Add(time.Hour)
+	later := time.Now().Add(2 * time.Hour)
+	notBefore := time.Now().Add(300 * time.Millisecond)
+
+	var jobs []Job
+	for _, j := range []struct {
+		task      string
+		priority  int
+		deadline  *time.Time
+		notBefore *time.Time
+	}{
+		{"plain", 0, nil, nil},
+		{"held", 10, nil, &notBefore},
+		{"later", 0, &later, nil},
+		{"urgent", 5, nil, nil},
+		{"soon", 0, &soon, nil},
+		{"plain-2", 0, nil, nil},
+	} {
+		jobs = append(jobs, enqueue(t, q, j.task, func(job *Job) {
+			job.Priority = j.priority
+			job.Deadline = j.deadline
+			job.NotBefore = j.notBefore
+		}))
+	}
+
+	close(release)
+	for _, job := range jobs {
+		waitState(t, q, job.ID, JobSucceeded)
+	}
+
+	want := []string{"urgent", "soon", "later", "plain", "plain-2", "held"}
+	got := ran.get()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dispatch order %v, want %v", got, want)
+		}
+	}
+}
+
+func TestQueueThrottleHoldsBackOnlyMatchingJobs(t *testing.T) {
+	ran := &runLog{}
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		ran.add(req.Task)
+		return nil
+	})
+
+	resume := time.Now().Add(300 * time.Millisecond)
+	q.Throttle(func(job Job, now time.Time) time.Time {
+		if job.Req.Task == "limited" {
+			return resume
+		}
+		return time.Time{}
+	})
+
+	limited := enqueue(t, q, "limited", nil)
+	free := enqueue(t, q, "free", nil)
+
+	waitState(t, q, free.ID, JobSucceeded)
+	if rec, _ := q.store.Get(limited.ID); rec.State != JobQueued {
+		t.Fatalf("throttled job is %s while paused", rec.State)
+	}
+	if stats := q.Stats(); stats.Paused != 1 || stats.PausedUntil == nil {
+		t.Fatalf("Stats = %+v, want one paused job", stats)
+	}
+
+	rec := waitState(t, q, limited.ID, JobSucceeded)
+	if rec.UpdatedAt.Before(resume) {
+		t.Fatalf("throttled job finished at %v, before %v", rec.UpdatedAt, resume)
+	}
+	if got := ran.get(); len(got) != 2 || got[0] != "free" {
+		t.Fatalf("dispatch order %v, want free first", got)
+	}
+}
+
+func TestQueueResize(t *testing.T) {
+	release := make(chan struct{})
+	var started atomic.Int32
+
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		started.Add(1)
+		<-release
+		return nil
+	})
+
+	if err := q.Resize(MaxWorkers + 1); err == nil {
+		t.Fatal("Resize past MaxWorkers succeeded")
+	}
+
+	var jobs []Job
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, enqueue(t, q, fmt.Sprintf("task-%d", i), nil))
+	}
+
+	waitFor(t, func() bool { return started.Load() == 1 })
+	if err := q.Resize(3); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return started.Load() == 3 })
+
+	// Shrinking lets busy workers finish their job before they exit.
+	if err := q.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	for _, job := range jobs {
+		waitState(t, q, job.ID, JobSucceeded)
+	}
+	waitFor(t, func() bool { return q.Stats().Live == 1 })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueRetriesAndDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	fixed := false
+
+	q := newTestQueue(t, 2, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		mu.Lock()
+		attempts[req.Task]++
+		n := attempts[req.Task]
+		ok := fixed
+		mu.Unlock()
+
+		switch req.Task {
+		case "flaky":
+			if n < 3 {
+				return &HTTPError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+			}
+			return nil
+		case "down":
+			return &HTTPError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+		default:
+			if ok {
+				return nil
+			}
+			return errors.New("bundle_validation_failed")
+		}
+	})
+
+	flaky := enqueue(t, q, "flaky", nil)
+	down := enqueue(t, q, "down", nil)
+	broken := enqueue(t, q, "broken", nil)
+
+	if rec := waitState(t, q, flaky.ID, JobSucceeded); rec.Job.Attempt != 3 {
+		t.Fatalf("flaky succeeded on attempt %d, want 3", rec.Job.Attempt)
+	}
+
+	rec := waitState(t, q, down.ID, JobFailed)
+	if rec.Job.Attempt != 3 || rec.ErrorClass != ErrTransient {
+		t.Fatalf("down dead-lettered after %d attempts as %s, want 3 transient", rec.Job.Attempt, rec.ErrorClass)
+	}
+
+	rec = waitState(t, q, broken.ID, JobFailed)
+	if rec.Job.Attempt != 1 || rec.ErrorClass != ErrPermanent {
+		t.Fatalf("broken dead-lettered after %d attempts as %s, want 1 permanent", rec.Job.Attempt, rec.ErrorClass)
+	}
+
+	// Requeueing gives the job a fresh set of attempts.
+	mu.Lock()
+	fixed = true
+	mu.Unlock()
+
+	if _, err := q.Requeue(flaky.ID, time.Second); err == nil {
+		t.Fatal("Requeue of a succeeded job worked")
+	}
+	if _, err := q.Requeue(broken.ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if rec := waitState(t, q, broken.ID, JobSucceeded); rec.Job.Attempt != 1 {
+		t.Fatalf("requeued job succeeded on attempt %d, want 1", rec.Job.Attempt)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	var ran sync.Map
+
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		ran.Store(req.Nonce, true)
+		<-ctx.Done()
+		return context.Cause(ctx)
+	})
+
+	running := enqueue(t, q, "task", nil)
+	queued := enqueue(t, q, "task", nil)
+	waitState(t, q, running.ID, JobRunning)
+
+	rec, err := q.Cancel(queued.ID)
+	if err != nil || rec.State != JobCanceled {
+		t.Fatalf("Cancel(queued) = %s, %v", rec.State, err)
+	}
+
+	if _, err := q.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	rec = waitState(t, q, running.ID, JobCanceled)
+	if rec.Job.Attempt != 1 {
+		t.Fatalf("canceled job was retried (attempt %d)", rec.Job.Attempt)
+	}
+
+	if _, ok := ran.Load(queued.Req.Nonce); ok {
+		t.Fatal("canceled queued job ran")
+	}
+	if _, err := q.Cancel(running.ID); err == nil {
+		t.Fatal("Cancel of a finished job worked")
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	release := make(chan struct{})
+	q := newTestQueue(t, 2, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		<-release
+		return nil
+	})
+
+	job := enqueue(t, q, "task", nil)
+	waitState(t, q, job.ID, JobRunning)
+
+	if q.Drain(20 * time.Millisecond) {
+		t.Fatal("Drain reported done with a job running")
+	}
+	if _, _, err := q.TryEnqueue(NewJob(UserRequest{Task: "late", Nonce: "late"}), time.Second); !errors.Is(err, errQueueDraining) {
+		t.Fatalf("TryEnqueue while draining = %v, want %v", err, errQueueDraining)
+	}
+
+	close(release)
+	if !q.Drain(5 * time.Second) {
+		t.Fatal("Drain timed out after the job finished")
+	}
+	waitState(t, q, job.ID, JobSucceeded)
+
+	if !q.Wait(5 * time.Second) {
+		t.Fatal("workers still running after drain")
+	}
+}
+
+func TestQueueRecoversPanics(t *testing.T) {
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		if req.Task == "panics" {
+			var m map[string]int
+			m["boom"]++
+		}
+		return nil
+	})
+
+	panicked := enqueue(t, q, "panics", nil)
+	after := enqueue(t, q, "after", nil)
+
+	rec := waitState(t, q, panicked.ID, JobFailed)
+	if rec.ErrorClass != ErrPermanent || rec.Job.Attempt != 1 || !strings.Contains(rec.Stack, "queue_test.go") {
+		t.Fatalf("panicked job: class %s, attempt %d, stack %q", rec.ErrorClass, rec.Job.Attempt, rec.Stack)
+	}
+
+	// The worker carries on with the next job.
+	waitState(t, q, after.ID, JobSucceeded)
+}
+
+func TestQueueFlagsStuckJobs(t *testing.T) {
+	release := make(chan struct{})
+	q := newTestQueue(t, 1, func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		report("slow_stage", EvaluatorRequest{})
+		<-release
+		return nil
+	})
+
+	job := enqueue(t, q, "task", nil)
+	waitFor(t, func() bool {
+		rec, _ := q.store.Get(job.ID)
+		return len(rec.Stages) > 0 && rec.Stages[len(rec.Stages)-1].Name == "slow_stage"
+	})
+
+	time.Sleep(10 * time.Millisecond)
+	q.flagStuck(map[string]time.Duration{"slow_stage": time.Millisecond})
+
+	if rec, _ := q.store.Get(job.ID); rec.StuckStage != "slow_stage" {
+		t.Fatalf("stuck stage = %q, want slow_stage", rec.StuckStage)
+	}
+
+	close(release)
+	if rec := waitState(t, q, job.ID, JobSucceeded); rec.StuckStage != "" {
+		t.Fatalf("stuck stage %q kept after the job finished", rec.StuckStage)
+	}
+}
+
+func TestQueueReplaysPendingJobsWithAttachments(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := UserRequest{Email: "student@example.com", Task: "replayed", Round: 1, Nonce: "r1"}
+	req.Attachments = []Attachment{{Name: "data.csv", URL: "data:text/csv;base64,YSxiCjEsMgo="}}
+	job := NewJob(req)
+	if _, _, err := store.Insert(JobRecord{Job: job, State: JobRunning}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	got := make(chan []Attachment, 1)
+	q := NewQueue(QueueConfig{Size: 1, Workers: 1, Timeout: 10 * time.Second}, store)
+	q.process = func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		got <- req.Attachments
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		q.Wait(5 * time.Second)
+	}()
+	q.Start(ctx)
+
+	select {
+	case atts := <-got:
+		if len(atts) != 1 || atts[0] != req.Attachments[0] {
+			t.Fatalf("replayed job has attachments %+v", atts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending job not replayed")
+	}
+	waitState(t, q, job.ID, JobSucceeded)
+}
+
+func TestQueueReplayOverCapacityKeepsSlotCount(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []Job
+	for _, task := range []string{"fits", "over"} {
+		job := NewJob(UserRequest{Email: "student@example.com", Task: task, Round: 1, Nonce: task})
+		if _, _, err := store.Insert(JobRecord{Job: job, State: JobQueued}); err != nil {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, job)
+	}
+	store.Close()
+
+	store, err = OpenJobStore(dir, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	gates := map[string]chan struct{}{"over": make(chan struct{}), "new": make(chan struct{})}
+	q := NewQueue(QueueConfig{Size: 1, Workers: 2, Timeout: 10 * time.Second}, store)
+	q.process = func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		if gate, ok := gates[req.Task]; ok {
+			<-gate
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		q.Wait(5 * time.Second)
+	}()
+	q.Start(ctx)
+
+	// Only the first replayed job got the single slot; it frees it when done.
+	waitState(t, q, replayed[0].ID, JobSucceeded)
+	waitState(t, q, replayed[1].ID, JobRunning)
+
+	held := enqueue(t, q, "new", nil)
+
+	// The job replayed over capacity finishing must not free held's slot.
+	close(gates["over"])
+	waitState(t, q, replayed[1].ID, JobSucceeded)
+
+	if _, _, err := q.TryEnqueue(NewJob(UserRequest{Task: "extra", Nonce: "extra"}), 50*time.Millisecond); err == nil {
+		t.Fatal("TryEnqueue went over capacity after a replayed job finished")
+	}
+
+	close(gates["new"])
+	waitState(t, q, held.ID, JobSucceeded)
+}
+
+func TestQueueResendWhileFullIsNotADuplicateOfALostJob(t *testing.T) {
+	store, err := OpenJobStore(t.TempDir(), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	release := make(chan struct{})
+	q := NewQueue(QueueConfig{Size: 1, Workers: 1, Timeout: 10 * time.Second}, store)
+	q.process = func(ctx context.Context, req UserRequest, report ReportFunc) error {
+		<-release
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		q.Wait(5 * time.Second)
+	}()
+	q.Start(ctx)
+
+	// The blocker holds the only slot.
+	blocker := enqueue(t, q, "blocker", nil)
+	waitState(t, q, blocker.ID, JobRunning)
+
+	req := UserRequest{Email: "student@example.com", Task: "task", Round: 1, Nonce: "n1"}
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := q.TryEnqueue(NewJob(req), 300*time.Millisecond)
+		first <- err
+	}()
+
+	// The evaluator resends while the first attempt still waits for a slot.
+	time.Sleep(50 * time.Millisecond)
+	rec, created, resendErr := q.TryEnqueue(NewJob(req), 50*time.Millisecond)
+
+	if err := <-first; err == nil {
+		t.Fatal("TryEnqueue into a full queue succeeded")
+	}
+	if resendErr == nil && !created {
+		if _, ok := store.Get(rec.Job.ID); !ok {
+			t.Fatalf("resend answered as a duplicate of %s, which was dropped", rec.Job.ID)
+		}
+	}
+
+	// Once there is room the request gets in, and only once.
+	close(release)
+	waitState(t, q, blocker.ID, JobSucceeded)
+
+	rec, created, err = q.TryEnqueue(NewJob(req), time.Second)
+	if err != nil || !created {
+		t.Fatalf("TryEnqueue = %v, %v", created, err)
+	}
+	again, created, err := q.TryEnqueue(NewJob(req), time.Second)
+	if err != nil || created || again.Job.ID != rec.Job.ID {
+		t.Fatalf("resend = %s, %v, %v; want duplicate of %s", again.Job.ID, created, err, rec.Job.ID)
+	}
+	waitState(t, q, rec.Job.ID, JobSucceeded)
+}
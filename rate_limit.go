@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateBudget tracks the request budget an API reports in its X-RateLimit-*
+// headers, plus any Retry-After it sent with a secondary limit. The queue
+// stops dispatching new jobs while a budget is paused.
+type RateBudget struct {
+	// Reserve is how many requests must be left for new jobs to start;
+	// running jobs may use the rest.
+	Reserve int
+
+	mu        sync.Mutex
+	known     bool
+	limit     int
+	remaining int
+	reset     time.Time
+	retryAt   time.Time
+}
+
+type RateBudgetStatus struct {
+	Limit       int        `json:"limit"`
+	Remaining   int        `json:"remaining"`
+	Reset       *time.Time `json:"reset,omitempty"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+var (
+	rateMu       sync.Mutex
+	rateBudgets  = map[string]*RateBudget{}
+	rateNames    = map[string]string{}
+	rateReserves = map[string]int{}
+)
+
+// TrackRateLimit starts recording the rate limit of every response from
+// host under name, e.g. "github" for api.github.com. Calls made with a
+// context from withRateBudget count against a budget of their own, named
+// "<name>/<key>", since each token has its own limit.
+func TrackRateLimit(name, host string, reserve int) *RateBudget {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+
+	rateNames[host] = name
+	rateReserves[name] = reserve
+	for n, b := range rateBudgets {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			b.Reserve = reserve
+		}
+	}
+
+	return rateBudget(name, reserve)
+}
+
+// rateBudget returns the budget called name, creating it if needed. Caller
+// holds rateMu.
+func rateBudget(name string, reserve int) *RateBudget {
+	b, ok := rateBudgets[name]
+	if !ok {
+		b = &RateBudget{Reserve: reserve}
+		rateBudgets[name] = b
+	}
+	return b
+}
+
+// RateBudgetName is the name of the budget key draws from on the API
+// tracked as name; the empty key is the API's own budget.
+func RateBudgetName(name, key string) string {
+	if key == "" {
+		return name
+	}
+	return name + "/" + key
+}
+
+type rateBudgetKey struct{}
+
+// withRateBudget makes calls made with ctx count against the budget key of
+// their API, e.g. one GitHub App installation's.
+func withRateBudget(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, rateBudgetKey{}, key)
+}
+
+// observeRateLimit feeds a response into the budget it was made against, if
+// its host is tracked.
+func observeRateLimit(resp *http.Response) {
+	key, _ := resp.Request.Context().Value(rateBudgetKey{}).(string)
+
+	rateMu.Lock()
+	var b *RateBudget
+	if name, ok := rateNames[resp.Request.URL.Host]; ok {
+		b = rateBudget(RateBudgetName(name, key), rateReserves[name])
+	}
+	rateMu.Unlock()
+
+	if b != nil {
+		b.Observe(resp.StatusCode, resp.Header)
+	}
+}
+
+// RateLimitPause returns the time work drawing on the named budgets may
+// start again. It is the zero time when none of them is paused.
+func RateLimitPause(now time.Time, names ...string) time.Time {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+
+	var until time.Time
+	for _, name := range names {
+		b, ok := rateBudgets[name]
+		if !ok {
+			continue
+		}
+		if t := b.PausedUntil(now); t.After(until) {
+			until = t
+		}
+	}
+	return until
+}
+
+// RateLimitedHost is implemented by hosts whose API budgets are tracked.
+type RateLimitedHost interface {
+	// RateBudgets names the budgets calls for the host's owner draw from.
+	RateBudgets() []string
+}
+
+// JobRateLimitPause is the queue's throttle: a job waits while a budget its
+// owner's host draws from is nearly spent, and jobs of other owners go ahead.
+func JobRateLimitPause(job Job, now time.Time) time.Time {
+	host, ok := HostFor(Host, Owners, job.Req).(RateLimitedHost)
+	if !ok {
+		return time.Time{}
+	}
+	return RateLimitPause(now, host.RateBudgets()...)
+}
+
+// RateLimitStatus is the current state of every tracked budget by name.
+func RateLimitStatus() map[string]RateBudgetStatus {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+
+	out := map[string]RateBudgetStatus{}
+	for name, b := range rateBudgets {
+		out[name] = b.Status()
+	}
+	return out
+}
+
+func (b *RateBudget) Observe(status int, h http.Header) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil {
+		b.known = true
+		b.remaining = remaining
+		if limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil {
+			b.limit = limit
+		}
+		if reset, ok := parseReset(h); ok {
+			b.reset = reset
+		}
+	}
+
+	if status == http.StatusForbidden || status == http.StatusTooManyRequests {
+		if d, ok := parseRetryAfter(h); ok {
+			if at := time.Now().Add(d); at.After(b.retryAt) {
+				b.retryAt = at
+			}
+		}
+	}
+}
+
+// PausedUntil returns when new work may start again, or the zero time if it
+// may start now.
+func (b *RateBudget) PausedUntil(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.pausedUntil(now)
+}
+
+func (b *RateBudget) pausedUntil(now time.Time) time.Time {
+	var until time.Time
+	if b.known && b.remaining <= b.Reserve && b.reset.After(now) {
+		until = b.reset
+	}
+	if b.retryAt.After(now) && b.retryAt.After(until) {
+		until = b.retryAt
+	}
+	return until
+}
+
+func (b *RateBudget) Status() RateBudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := RateBudgetStatus{Limit: b.limit, Remaining: b.remaining}
+	if !b.reset.IsZero() {
+		reset := b.reset
+		s.Reset = &reset
+	}
+	if until := b.pausedUntil(time.Now()); !until.IsZero() {
+		s.PausedUntil = &until
+	}
+	return s
+}
+
+// parseReset reads X-RateLimit-Reset, the Unix time the budget refills.
+func parseReset(h http.Header) (time.Time, bool) {
+	secs, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// parseRetryAfter reads how long to wait before trying again: Retry-After in
+// seconds or as an HTTP date, or failing that the time until the primary
+// limit resets when it has run out.
+func parseRetryAfter(h http.Header) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			return max(time.Until(at), 0), true
+		}
+	}
+
+	if h.Get("X-RateLimit-Remaining") == "0" {
+		if reset, ok := parseReset(h); ok {
+			return max(time.Until(reset), 0), true
+		}
+	}
+
+	return 0, false
+}
+
+// retryAfter returns the wait the server asked for with err, if any.
+func retryAfter(err error) (time.Duration, bool) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		return httpErr.RetryAfter, true
+	}
+	return 0, false
+}
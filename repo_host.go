@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RepoHost is where generated projects are published: it owns the repos, their
+// files and commits, and the static site (Pages) built from them.
+type RepoHost interface {
+	// Check verifies the host is reachable and the credentials work.
+	Check(ctx context.Context) error
+
+	ListRepositories(ctx context.Context) ([]Repository, error)
+	RepositoryExists(ctx context.Context, name string) (bool, error)
+	// CreateRepository creates a public repo whose default branch already
+	// exists, so it can be committed to straight away.
+	CreateRepository(ctx context.Context, name string) error
+	// DeleteRepository refuses, with ErrNotManaged, any repo that doesn't
+	// carry the MarkerPath file.
+	DeleteRepository(ctx context.Context, name string) error
+	// ArchiveRepository renames a repo to newName and makes it read-only
+	// where the host supports that. Like DeleteRepository, it refuses repos
+	// without the marker.
+	ArchiveRepository(ctx context.Context, name, newName string) error
+	// UpdateMetadata sets the repo's description, homepage and topics, as
+	// far as the host has them.
+	UpdateMetadata(ctx context.Context, name string, meta RepoMetadata) error
+
+	// GetFile returns the blob SHA and content of a file on the default
+	// branch. It wraps ErrNotFound if the file doesn't exist.
+	GetFile(ctx context.Context, repo, path string) (sha string, content []byte, err error)
+	// Commit writes files on top of the default branch as a single commit and
+	// returns its SHA. Either every file lands or none do.
+	Commit(ctx context.Context, repo, message string, files []FileChange) (string, error)
+	// ResetBranch replaces the content of the default branch with just
+	// files and returns the new head. Hosts that can rewrite history make it
+	// a new root commit; the others commit the removal of every other file.
+	ResetBranch(ctx context.Context, repo, message string, files []FileChange) (string, error)
+
+	LastCommit(ctx context.Context, repo string) (string, error)
+	// CreateRelease points an annotated tag at rel.SHA and publishes a
+	// release for it where the host has releases. A tag or release that
+	// already exists is replaced, so a retried round ends up the same.
+	CreateRelease(ctx context.Context, repo string, rel Release) error
+
+	SetupPages(ctx context.Context, repo string) error
+	// WaitForPages blocks until the site has been built from commit sha.
+	WaitForPages(ctx context.Context, repo, sha string) error
+
+	RepoURL(repo string) string
+	PagesURL(repo string) string
+}
+
+// FileChange is one file of a commit: its path from the repo root and its
+// full new content.
+type FileChange struct {
+	Path string
+	Data []byte
+}
+
+// RepoMetadata is what a repo says about itself on the host's pages.
+type RepoMetadata struct {
+	Description string
+	Homepage    string
+	Topics      []string
+}
+
+// Release marks the commit a round published. Name and Notes become the
+// annotated tag's message as well as the release's title and body.
+type Release struct {
+	Tag   string
+	SHA   string
+	Name  string
+	Notes string
+}
+
+// Message is the annotated tag message for the release.
+func (r Release) Message() string {
+	return r.Name + "\n\n" + r.Notes
+}
+
+var ErrNotFound = errors.New("not_found")
+
+// exists turns the result of fetching a single resource into an existence
+// check: found, a 404, or some other failure.
+func exists(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// wrapNotFound marks a 404 from a host's API as ErrNotFound.
+func wrapNotFound(err error) error {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+// ignoreNotFound treats a 404 as success, for deleting something that may
+// already be gone.
+func ignoreNotFound(err error) error {
+	if errors.Is(wrapNotFound(err), ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// OwnerScoped is implemented by hosts that can publish under more than one
+// account, such as a user and the organizations they belong to.
+type OwnerScoped interface {
+	// WithOwner returns the host bound to owner.
+	WithOwner(owner string) RepoHost
+}
+
+// PullRequester is implemented by hosts that can stage a commit on a side
+// branch and merge it into the default branch through a pull request.
+type PullRequester interface {
+	// CommitBranch commits files on top of the default branch's head and
+	// points branch at the result, creating or moving it as needed.
+	CommitBranch(ctx context.Context, repo, branch, message string, files []FileChange) (string, error)
+	// OpenPullRequest opens a pull request from branch into the default
+	// branch, or returns the one already open for it.
+	OpenPullRequest(ctx context.Context, repo, branch, title, body string) (PullRequest, error)
+	// MergePullRequest merges the pull request with a merge commit, deletes
+	// its branch and returns the merge commit's SHA.
+	MergePullRequest(ctx context.Context, repo string, pr PullRequest, message string) (string, error)
+}
+
+type PullRequest struct {
+	Number int    `json:"number"`
+	URL    string `json:"html_url"`
+	Branch string `json:"-"`
+}
+
+// OwnerMap picks the account a request's repo is published under from the
+// requester's email. Keys are either a full address or a domain starting
+// with "@"; an exact address wins over its domain.
+type OwnerMap map[string]string
+
+// ParseOwnerMap reads "key=owner" pairs separated by commas, e.g.
+// "@example.com=example-org,alice@example.com=alice".
+func ParseOwnerMap(s string) (OwnerMap, error) {
+	m := OwnerMap{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, owner, ok := strings.Cut(pair, "=")
+		key, owner = strings.TrimSpace(key), strings.TrimSpace(owner)
+		if !ok || key == "" || owner == "" {
+			return nil, fmt.Errorf("invalid_owner_mapping:%s", pair)
+		}
+		m[strings.ToLower(key)] = owner
+	}
+	return m, nil
+}
+
+// Owner returns the owner mapped to email, or "" to use the host's default.
+func (m OwnerMap) Owner(email string) string {
+	email = strings.ToLower(email)
+	if owner, ok := m[email]; ok {
+		return owner
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return m[email[i:]]
+	}
+	return ""
+}
+
+// HostFor returns host bound to the owner req maps to, or host itself if
+// there is no mapping or the host has a single owner.
+func HostFor(host RepoHost, owners OwnerMap, req UserRequest) RepoHost {
+	scoped, ok := host.(OwnerScoped)
+	if !ok {
+		return host
+	}
+
+	if owner := owners.Owner(req.Email); owner != "" {
+		return scoped.WithOwner(owner)
+	}
+	return host
+}
+
+// Host is the RepoHost rounds publish to, chosen by REPO_HOST in InitGit.
+// Owners maps requests to accounts on it, from REPO_OWNER_MAP, Replace is
+// what round 1 does about an existing repo, from REPO_REPLACE_POLICY, and
+// PullRequests sends round 2 through a pull request, from
+// ROUND2_PULL_REQUESTS. Pages bounds the wait for the live site, and
+// Attachments the size of what a request may attach. Templates are what
+// round 1 repos can start from, from TEMPLATES_FILE.
+var (
+	Host         RepoHost
+	Owners       OwnerMap
+	Replace      ReplacePolicy
+	PullRequests bool
+	Pages        PagesConfig
+	Attachments  = LoadAttachmentLimits()
+	Templates    *TemplateSet
+)
+
+func NewRepoHost(kind string) (RepoHost, error) {
+	switch kind {
+	case "github":
+		g, err := NewGitHubFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	case "gitea":
+		g, err := NewGiteaFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	case "gitlab":
+		return NewGitLabFromEnv(), nil
+	case "local":
+		return NewLocalHostFromEnv(), nil
+	case "memory":
+		return NewMemoryHost(EnvOr("MEMORY_HOST_OWNER", "dry-run")), nil
+	default:
+		return nil, fmt.Errorf("unknown_repo_host:%s", kind)
+	}
+}
+
+func InitGit(ctx context.Context) error {
+	host, err := NewRepoHost(EnvOr("REPO_HOST", "github"))
+	if err != nil {
+		return err
+	}
+
+	owners, err := ParseOwnerMap(os.Getenv("REPO_OWNER_MAP"))
+	if err != nil {
+		return err
+	}
+
+	policy, err := ParseReplacePolicy(EnvOr("REPO_REPLACE_POLICY", string(ReplaceReset)))
+	if err != nil {
+		return err
+	}
+
+	templates, err := LoadTemplates(os.Getenv("TEMPLATES_FILE"))
+	if err != nil {
+		return err
+	}
+	if err := templates.Check(host); err != nil {
+		return err
+	}
+
+	if err := host.Check(ctx); err != nil {
+		return err
+	}
+	if scoped, ok := host.(OwnerScoped); ok {
+		for _, owner := range owners {
+			if err := scoped.WithOwner(owner).Check(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	Host = host
+	Owners = owners
+	Replace = policy
+	PullRequests = EnvBool("ROUND2_PULL_REQUESTS", false)
+	Pages = LoadPagesConfig()
+	Attachments = LoadAttachmentLimits()
+	Templates = templates
+
+	if _, ok := host.(PullRequester); PullRequests && !ok {
+		log.Printf("REPO_HOST=%s has no pull requests, round 2 commits directly", EnvOr("REPO_HOST", "github"))
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDescription keeps descriptions well inside every host's limit (GitHub
+// allows 350 characters).
+const maxDescription = 200
+
+// maxTopics is how many topics a repo gets, the marker topic included.
+const maxTopics = 10
+
+var topicWordPattern = regexp.MustCompile(`[a-z]+`)
+
+// topicStopWords are words too common in task names to say anything.
+var topicStopWords = map[string]bool{
+	"and": true, "app": true, "for": true, "the": true, "with": true,
+}
+
+// NewRepoMetadata describes the repo for req: the brief's first sentence,
+// the site as homepage, and topics from the task's name.
+func NewRepoMetadata(req UserRequest, pagesURL string) RepoMetadata {
+	return RepoMetadata{
+		Description: describeBrief(req),
+		Homepage:    pagesURL,
+		Topics:      taskTopics(req.Task),
+	}
+}
+
+// describeBrief returns the first sentence of the brief on one line, cut
+// to maxDescription characters.
+func describeBrief(req UserRequest) string {
+	desc := strings.Join(strings.Fields(req.Brief), " ")
+	if i := strings.Index(desc, ". "); i >= 0 {
+		desc = desc[:i+1]
+	}
+	if desc == "" {
+		return fmt.Sprintf("Generated site for %s", req.Task)
+	}
+
+	if utf8.RuneCountInString(desc) > maxDescription {
+		runes := []rune(desc)
+		desc = strings.TrimSpace(string(runes[:maxDescription-1])) + "…"
+	}
+	return desc
+}
+
+// taskTopics turns a task name such as "markdown-to-html-3f9a1" into topics
+// ("project-1-sdt", "markdown", "html"). Only all-letter words of three or
+// more letters are kept, which drops the usual hash or counter suffix and
+// keeps every topic valid on GitHub.
+func taskTopics(task string) []string {
+	topics := []string{markerOwner}
+	seen := map[string]bool{markerOwner: true}
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(task), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == ' '
+	}) {
+		if len(topics) == maxTopics {
+			break
+		}
+		if len(word) < 3 || topicWordPattern.FindString(word) != word || topicStopWords[word] || seen[word] {
+			continue
+		}
+
+		seen[word] = true
+		topics = append(topics, word)
+	}
+
+	return topics
+}
+
+// NewRelease is the release for the round req published as sha, tagged
+// "round-N".
+func NewRelease(req UserRequest, sha string) Release {
+	return Release{
+		Tag:   fmt.Sprintf("round-%d", req.Round),
+		SHA:   sha,
+		Name:  fmt.Sprintf("Round %d of %s", req.Round, req.Task),
+		Notes: releaseNotes(req),
+	}
+}
+
+// releaseNotes lists what the round was asked to do.
+func releaseNotes(req UserRequest) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Round %d of `%s`, requested by %s.\n\n", req.Round, req.Task, req.Email)
+	writeRoundSummary(&b, req, "- ")
+
+	return b.String()
+}
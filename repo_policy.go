@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// MarkerPath is the file that marks a repo as created by this service. Hosts
+// only delete repos that carry it.
+const MarkerPath = ".sdt-managed.json"
+
+const markerOwner = "project-1-sdt"
+
+var ErrNotManaged = errors.New("repo_not_managed")
+
+// RepoMarker is the content of MarkerPath. Request identifies the round 1
+// request that created the repo without publishing its nonce.
+type RepoMarker struct {
+	ManagedBy string    `json:"managed_by"`
+	Task      string    `json:"task"`
+	Request   string    `json:"request"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewRepoMarker(req UserRequest) RepoMarker {
+	return RepoMarker{
+		ManagedBy: markerOwner,
+		Task:      req.Task,
+		Request:   requestHash(req),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func requestHash(req UserRequest) string {
+	sum := sha256.Sum256([]byte(req.Email + "\x00" + req.Task + "\x00" + req.Nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m RepoMarker) File() FileChange {
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return FileChange{Path: MarkerPath, Data: append(data, '\n')}
+}
+
+// ReadRepoMarker returns the repo's marker, or nil if it has none.
+func ReadRepoMarker(ctx context.Context, host RepoHost, repo string) (*RepoMarker, error) {
+	_, data, err := host.GetFile(ctx, repo, MarkerPath)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m RepoMarker
+	if err := json.Unmarshal(data, &m); err != nil || m.ManagedBy != markerOwner {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// requireManaged fails with ErrNotManaged unless repo carries the marker.
+// Hosts call it before anything destructive.
+func requireManaged(ctx context.Context, host RepoHost, repo string) error {
+	m, err := ReadRepoMarker(ctx, host, repo)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%w:%s", ErrNotManaged, repo)
+	}
+	return nil
+}
+
+// ReplacePolicy says what round 1 does when a repo with the task's name
+// already exists.
+type ReplacePolicy string
+
+const (
+	// ReplaceRefuse fails the round and leaves the repo alone.
+	ReplaceRefuse ReplacePolicy = "refuse"
+	// ReplaceArchive renames the repo out of the way, archives it, and
+	// starts a fresh one. Only repos carrying the marker are archived.
+	ReplaceArchive ReplacePolicy = "archive"
+	// ReplaceReset keeps the repo and resets its default branch to a new
+	// root commit. Only repos carrying the marker are reset.
+	ReplaceReset ReplacePolicy = "reset"
+)
+
+func ParseReplacePolicy(s string) (ReplacePolicy, error) {
+	switch p := ReplacePolicy(s); p {
+	case ReplaceRefuse, ReplaceArchive, ReplaceReset:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown_replace_policy:%s", s)
+	}
+}
+
+// archiveName is where ReplaceArchive moves an existing repo.
+func archiveName(repo string, now time.Time) string {
+	return fmt.Sprintf("%s-archived-%s", repo, now.UTC().Format("20060102-150405"))
+}
+
+// claimRepo leaves the round with a marked repo named after the task to
+// publish into. A repo this same request created on an earlier attempt is
+// picked up as is; any other existing repo is handled by policy. A new repo
+// is generated from template when one is given, and generated reports
+// whether that happened, i.e. whether the template's files are already in.
+func claimRepo(ctx context.Context, host RepoHost, req UserRequest, policy ReplacePolicy, template string) (generated bool, err error) {
+	name := req.Task
+	marker := NewRepoMarker(req)
+
+	hasRepo, err := host.RepositoryExists(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	if hasRepo {
+		current, err := ReadRepoMarker(ctx, host, name)
+		if err != nil {
+			return false, err
+		}
+
+		if current != nil && current.Request == marker.Request {
+			log.Printf("resuming in %s, created by an earlier attempt", name)
+			return false, nil
+		}
+
+		if current == nil && policy != ReplaceRefuse {
+			return false, fmt.Errorf("%w:%s", ErrNotManaged, name)
+		}
+
+		switch policy {
+		case ReplaceReset:
+			_, err := host.ResetBranch(ctx, name, fmt.Sprintf("chore: reset %s for a new round 1", name), []FileChange{marker.File()})
+			return false, err
+
+		case ReplaceArchive:
+			archived := archiveName(name, time.Now())
+			log.Printf("archiving existing repo %s as %s", name, archived)
+
+			if err := host.ArchiveRepository(ctx, name, archived); err != nil {
+				return false, fmt.Errorf("archive_repo(%s): %w", name, err)
+			}
+
+		default:
+			return false, fmt.Errorf("repo_exists:%s", name)
+		}
+	}
+
+	if gen, ok := host.(TemplateHost); ok && template != "" {
+		err = gen.GenerateRepository(ctx, template, name)
+		generated = err == nil
+	} else {
+		err = host.CreateRepository(ctx, name)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = host.Commit(ctx, name, "chore: mark repo as managed by "+markerOwner, []FileChange{marker.File()})
+	return generated, err
+}
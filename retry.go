@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+)
+
+type ErrorClass string
+
+const (
+	// ErrTransient covers network errors, timeouts and 5xx from GitHub or
+	// OpenAI: the same request is likely to work later.
+	ErrTransient ErrorClass = "transient"
+	// ErrRateLimited is a 429 or a GitHub rate-limit 403; it needs a longer wait.
+	ErrRateLimited ErrorClass = "rate_limited"
+	// ErrPermanent covers bad input and failed validation; retrying won't help.
+	ErrPermanent ErrorClass = "permanent"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultRetryPolicies = map[ErrorClass]RetryPolicy{
+	ErrTransient:   {MaxAttempts: 5, BaseDelay: 10 * time.Second, MaxDelay: 5 * time.Minute},
+	ErrRateLimited: {MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: 15 * time.Minute},
+	ErrPermanent:   {MaxAttempts: 1},
+}
+
+// LoadRetryPolicies reads RETRY_<CLASS>_ATTEMPTS, RETRY_<CLASS>_BASE_DELAY
+// and RETRY_<CLASS>_MAX_DELAY on top of the defaults.
+func LoadRetryPolicies() map[ErrorClass]RetryPolicy {
+	policies := map[ErrorClass]RetryPolicy{}
+
+	for class, def := range defaultRetryPolicies {
+		prefix := "RETRY_" + strings.ToUpper(string(class))
+		policies[class] = RetryPolicy{
+			MaxAttempts: EnvInt(prefix+"_ATTEMPTS", def.MaxAttempts),
+			BaseDelay:   EnvDuration(prefix+"_BASE_DELAY", def.BaseDelay),
+			MaxDelay:    EnvDuration(prefix+"_MAX_DELAY", def.MaxDelay),
+		}
+	}
+
+	return policies
+}
+
+// Backoff returns the wait before the next attempt: exponential in the
+// number of attempts made so far, capped at MaxDelay, with half of it
+// randomised so retries from a burst spread out.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func ClassifyError(err error) ErrorClass {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return classifyStatus(httpErr.StatusCode, httpErr.Body)
+	}
+
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		return classifyStatus(apiErr.StatusCode, "")
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errOpenAIEmptyResponse) {
+		return ErrTransient
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrTransient
+	}
+
+	return ErrPermanent
+}
+
+func classifyStatus(code int, body string) ErrorClass {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case code == http.StatusForbidden && strings.Contains(strings.ToLower(body), "rate limit"):
+		return ErrRateLimited
+	case code == http.StatusRequestTimeout || code >= 500:
+		return ErrTransient
+	default:
+		return ErrPermanent
+	}
+}
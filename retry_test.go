@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want ErrorClass
+	}{
+		{&HTTPError{StatusCode: http.StatusBadGateway}, ErrTransient},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests}, ErrRateLimited},
+		{&HTTPError{StatusCode: http.StatusForbidden, Body: "API rate limit exceeded"}, ErrRateLimited},
+		{&HTTPError{StatusCode: http.StatusUnprocessableEntity}, ErrPermanent},
+		{fmt.Errorf("frontend: %w", context.DeadlineExceeded), ErrTransient},
+		{fmt.Errorf("frontend: %w", errOpenAIEmptyResponse), ErrTransient},
+		{errors.New("bundle_validation_failed"), ErrPermanent},
+	} {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// licenseFile is the LICENSE every round 1 repo starts with.
+func licenseFile() FileChange {
+	return FileChange{
+		Path: "LICENSE",
+		Data: []byte(CreateLicense(fmt.Sprintf("%s <%s>",
+			os.Getenv("GITHUB_NAME"),
+			os.Getenv("GITHUB_EMAIL")))),
+	}
+}
+
+// waitForSite waits for Pages to build sha and then for the live site to
+// serve the round's build stamp. A build or deployment that fails fails the
+// round, so it is retried or dead-lettered like any other error. A site that
+// is merely late doesn't block the evaluator callback: it is logged and the
+// round goes on.
+func waitForSite(ctx context.Context, host RepoHost, name, sha, stamp string, evalReq EvaluatorRequest, report ReportFunc) error {
+	if err := host.WaitForPages(ctx, name, sha); err != nil {
+		if !errors.Is(err, errPagesTimeout) {
+			return fmt.Errorf("wait_for_pages(%s): %w", name, err)
+		}
+		log.Printf("Pages build for %s did not complete: %v", name, err)
+		return nil
+	}
+	report("pages_built", evalReq)
+
+	if err := VerifyPages(ctx, host.PagesURL(name), stamp, Pages); err != nil {
+		log.Printf("Pages site for %s does not serve %s yet: %v", name, stamp, err)
+		return nil
+	}
+	report("pages_verified", evalReq)
+	return nil
+}
+
+// publishRelease tags the commit a round published and creates its release.
+// It runs once the evaluator has the round, so a failure is only logged.
+func publishRelease(ctx context.Context, host RepoHost, req UserRequest, sha string, evalReq EvaluatorRequest, report ReportFunc) {
+	rel := NewRelease(req, sha)
+	if err := host.CreateRelease(ctx, req.Task, rel); err != nil {
+		log.Printf("release %s of %s failed: %v", rel.Tag, req.Task, err)
+		return
+	}
+	report("released", evalReq)
+}
+
+// stageAttachments decodes the request's attachments into files for the
+// round's commit and lists them for the model under their repo paths. On
+// hosts with Git LFS whose Pages serve LFS content, attachments over the LFS
+// threshold are uploaded there right away and only their pointers are
+// committed, along with the .gitattributes entries that mark them. Elsewhere
+// they are committed whole, since a pointer would break the site.
+func stageAttachments(ctx context.Context, host RepoHost, req UserRequest, vr *VibeRequest) ([]FileChange, error) {
+	if err := Attachments.Check(req.Attachments); err != nil {
+		return nil, err
+	}
+
+	lfs, hasLFS := host.(LFSHost)
+	if hasLFS && Attachments.LFSThreshold > 0 && len(req.Attachments) > 0 {
+		resolves, err := lfs.PagesResolveLFS(ctx, req.Task)
+		if err != nil {
+			return nil, fmt.Errorf("pages_resolve_lfs: %w", err)
+		}
+		hasLFS = resolves
+	}
+
+	var files []FileChange
+	var lfsPaths []string
+
+	for _, att := range req.Attachments {
+		du, err := ParseDataURL(att.URL)
+		if err != nil {
+			return nil, fmt.Errorf("decode_data_url(%s): %w", att.Name, err)
+		}
+
+		dst := fmt.Sprintf("%s-%s", GenerateUUID(), att.Name)
+
+		if hasLFS && Attachments.LFSThreshold > 0 && du.Size() >= Attachments.LFSThreshold {
+			obj, err := UploadLFS(ctx, lfs, req.Task, du.Open)
+			if err != nil {
+				return nil, fmt.Errorf("upload_lfs(%s): %w", att.Name, err)
+			}
+
+			files = append(files, FileChange{Path: dst, Data: obj.Pointer()})
+			lfsPaths = append(lfsPaths, dst)
+		} else {
+			decoded, err := du.Decode()
+			if err != nil {
+				return nil, fmt.Errorf("decode_data_url(%s): %w", att.Name, err)
+			}
+
+			files = append(files, FileChange{Path: dst, Data: decoded.Data})
+		}
+
+		vr.Attachements = append(vr.Attachements, VibeAttachement{
+			Filename: att.Name,
+			URL:      "./" + dst,
+		})
+	}
+
+	if len(lfsPaths) > 0 {
+		attrs, err := lfsAttributes(ctx, host, req.Task, lfsPaths)
+		if err != nil {
+			return nil, fmt.Errorf("get .gitattributes: %w", err)
+		}
+		files = append(files, attrs)
+	}
+
+	return files, nil
+}
+
+func Round1(ctx context.Context, host RepoHost, req UserRequest, report ReportFunc) error {
+	err := host.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := req.Task
+
+	evalReq := EvaluatorRequest{
+		Email:    req.Email,
+		Task:     req.Task,
+		Round:    1,
+		Nonce:    req.Nonce,
+		RepoURL:  host.RepoURL(name),
+		PagesURL: host.PagesURL(name),
+	}
+
+	tmpl := Templates.Pick(req)
+
+	generated, err := claimRepo(ctx, host, req, Replace, tmpl.generatedFrom(host))
+	if err != nil {
+		return err
+	}
+
+	if err := host.SetupPages(ctx, name); err != nil {
+		return err
+	}
+
+	if err := host.UpdateMetadata(ctx, name, NewRepoMetadata(req, evalReq.PagesURL)); err != nil {
+		log.Printf("metadata for %s not updated: %v", name, err)
+	}
+	report("repo_created", evalReq)
+
+	vr := VibeRequest{
+		Prompt:       req.Brief,
+		Checks:       StringArrToString(req.Checks),
+		Attachements: []VibeAttachement{},
+	}
+
+	// Everything the round writes goes into a single commit at the end, so
+	// a failure before then leaves nothing half-written in the repo. A
+	// template's files come first, unless the repo was generated with them.
+	var scaffold, files []FileChange
+	if tmpl != nil {
+		log.Printf("starting %s from template %s", name, tmpl.Name)
+
+		if scaffold, err = tmpl.Files(ctx, host); err != nil {
+			return fmt.Errorf("template %s: %w", tmpl.Name, err)
+		}
+		if !generated {
+			files = append(files, scaffold...)
+		}
+	}
+	files = append(files, licenseFile())
+
+	attachments, err := stageAttachments(ctx, host, req, &vr)
+	if err != nil {
+		return err
+	}
+	files = append(files, attachments...)
+	report("attachments_uploaded", evalReq)
+
+	var vibed *[]VibeResponse
+	if tmpl != nil {
+		shown, listed := scaffoldContext(scaffold)
+		vibed, err = GenerateFromTemplate(ctx, vr, tmpl.Description, shown, listed)
+	} else {
+		vibed, err = GenerateFrontend(ctx, vr)
+	}
+	if err != nil {
+		return err
+	}
+	report("frontend_generated", evalReq)
+
+	for _, file := range *vibed {
+		files = append(files, FileChange{Path: file.Filename, Data: []byte(file.Content)})
+	}
+	files = mergeFiles(files)
+	stamp := BuildStamp(req)
+	stampFiles(files, stamp)
+
+	sha, err := host.Commit(ctx, name, fmt.Sprintf("feat: round 1 for %s", name), files)
+	if err != nil {
+		return err
+	}
+	evalReq.CommitSHA = sha
+	report("files_committed", evalReq)
+
+	if err := waitForSite(ctx, host, name, sha, stamp, evalReq, report); err != nil {
+		return err
+	}
+
+	if err := SatisfyEvaluator(ctx, evalReq, req.EvaluationURL); err != nil {
+		return err
+	}
+	report("evaluator_notified", evalReq)
+
+	publishRelease(ctx, host, req, sha, evalReq, report)
+
+	return nil
+}
+
+// validateBundle logs every problem with the model's output and fails if
+// there were any.
+func validateBundle(bundle []VibeResponse) error {
+	verrs := ValidateVibeBundle(bundle)
+	if len(verrs) == 0 {
+		return nil
+	}
+
+	for _, e := range verrs {
+		log.Printf("bundle validation error: %v", e)
+	}
+	return fmt.Errorf("bundle_validation_failed")
+}
+
+// commitRound2 validates the bundle and commits it straight to the default
+// branch.
+func commitRound2(ctx context.Context, host RepoHost, name, message string, files []FileChange, bundle []VibeResponse) (string, error) {
+	if err := validateBundle(bundle); err != nil {
+		return "", err
+	}
+
+	return host.Commit(ctx, name, message, files)
+}
+
+// mergeRound2 commits the round to a branch and opens a pull request for it,
+// then merges it only if the bundle validates. A bundle that doesn't is left
+// open for review and the round fails. The merge commit is what gets
+// reported.
+func mergeRound2(ctx context.Context, host PullRequester, req UserRequest, message string, files []FileChange, bundle []VibeResponse, evalReq EvaluatorRequest, report ReportFunc) (string, error) {
+	name := req.Task
+	branch := fmt.Sprintf("sdt/round-2-%s", requestHash(req)[:12])
+
+	if _, err := host.CommitBranch(ctx, name, branch, message, files); err != nil {
+		return "", err
+	}
+
+	pr, err := host.OpenPullRequest(ctx, name, branch, fmt.Sprintf("Round 2 for %s", name), pullRequestBody(req))
+	if err != nil {
+		return "", err
+	}
+	log.Printf("opened pull request #%d for %s: %s", pr.Number, name, pr.URL)
+	report("pull_request_opened", evalReq)
+
+	if err := validateBundle(bundle); err != nil {
+		return "", fmt.Errorf("%w: pull request #%d left open", err, pr.Number)
+	}
+
+	return host.MergePullRequest(ctx, name, pr, fmt.Sprintf("Merge round 2 for %s (#%d)", name, pr.Number))
+}
+
+// pullRequestBody summarizes the round for whoever reviews the pull request.
+func pullRequestBody(req UserRequest) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Round 2 update for `%s`, requested by %s.\n\n", req.Task, req.Email)
+	writeRoundSummary(&b, req, "- [ ] ")
+
+	b.WriteString("\nThis pull request is merged automatically once the generated bundle passes validation.\n")
+	return b.String()
+}
+
+// writeRoundSummary writes the brief, checks and attachments of req as
+// Markdown sections, with each check behind checkBullet.
+func writeRoundSummary(b *strings.Builder, req UserRequest, checkBullet string) {
+	fmt.Fprintf(b, "## Brief\n\n%s\n", req.Brief)
+
+	if len(req.Checks) > 0 {
+		b.WriteString("\n## Checks\n\n")
+		for _, c := range req.Checks {
+			fmt.Fprintf(b, "%s%s\n", checkBullet, c)
+		}
+	}
+
+	if len(req.Attachments) > 0 {
+		b.WriteString("\n## Attachments\n\n")
+		for _, a := range req.Attachments {
+			fmt.Fprintf(b, "- %s\n", a.Name)
+		}
+	}
+}
+
+func Round2(ctx context.Context, host RepoHost, req UserRequest, report ReportFunc) error {
+	// Ensure repo exists
+	name := req.Task
+
+	evalReq := EvaluatorRequest{
+		Email:    req.Email,
+		Task:     req.Task,
+		Round:    2,
+		Nonce:    req.Nonce,
+		RepoURL:  host.RepoURL(name),
+		PagesURL: host.PagesURL(name),
+	}
+
+	// Load current bundle
+	_, readmeContent, err := host.GetFile(ctx, name, "README.md")
+	if err != nil {
+		return fmt.Errorf("get README.md: %w", err)
+	}
+	_, indexContent, err := host.GetFile(ctx, name, "index.html")
+	if err != nil {
+		return fmt.Errorf("get index.html: %w", err)
+	}
+
+	existing := []VibeResponse{
+		{Type: "markdown", Filename: "README.md", Content: string(readmeContent)},
+		{Type: "html", Filename: "index.html", Content: string(indexContent)},
+	}
+	report("files_loaded", evalReq)
+
+	vr := VibeRequest{
+		Prompt:       req.Brief,
+		Checks:       StringArrToString(req.Checks),
+		Attachements: []VibeAttachement{},
+	}
+
+	files, err := stageAttachments(ctx, host, req, &vr)
+	if err != nil {
+		return err
+	}
+	report("attachments_uploaded", evalReq)
+
+	// Ask the model to modify based on the current files
+	modified, err := ModifyFrontend(ctx, vr, existing)
+	if err != nil {
+		return err
+	}
+	report("frontend_generated", evalReq)
+
+	for _, f := range *modified {
+		if f.Filename != "README.md" && f.Filename != "index.html" {
+			return fmt.Errorf("unexpected filename in round2: %s", f.Filename)
+		}
+		files = append(files, FileChange{Path: f.Filename, Data: []byte(f.Content)})
+	}
+	stamp := BuildStamp(req)
+	stampFiles(files, stamp)
+
+	message := fmt.Sprintf("chore: round 2 for %s", name)
+
+	var sha string
+	if pr, ok := host.(PullRequester); ok && PullRequests {
+		sha, err = mergeRound2(ctx, pr, req, message, files, *modified, evalReq, report)
+	} else {
+		sha, err = commitRound2(ctx, host, name, message, files, *modified)
+	}
+	if err != nil {
+		return err
+	}
+	evalReq.CommitSHA = sha
+	report("files_committed", evalReq)
+
+	if err := waitForSite(ctx, host, name, sha, stamp, evalReq, report); err != nil {
+		return err
+	}
+
+	if err := SatisfyEvaluator(ctx, evalReq, req.EvaluationURL); err != nil {
+		return err
+	}
+	report("evaluator_notified", evalReq)
+
+	publishRelease(ctx, host, req, sha, evalReq, report)
+
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeModel answers every chat completion with bundle, as YAML. Rounds that
+// set up their own client from OPENAI_KEY get it through OPENAI_BASE_URL.
+func fakeModel(t *testing.T, bundle []VibeResponse) {
+	t.Helper()
+
+	content, err := yaml.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if strings.HasSuffix(r.URL.Path, "/models") {
+			w.Write([]byte(`{"object":"list","data":[]}`))
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":      "chatcmpl-test",
+			"object":  "chat.completion",
+			"created": 0,
+			"model":   "gpt-5-mini",
+			"choices": []map[string]any{{
+				"index":         0,
+				"finish_reason": "stop",
+				"message":       map[string]any{"role": "assistant", "content": string(content)},
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OPENAI_KEY", "test")
+	t.Setenv("OPENAI_BASE_URL", srv.URL+"/")
+
+	saved := OpenAI
+	OpenAI = openai.NewClient(option.WithBaseURL(srv.URL+"/"), option.WithAPIKey("test"), option.WithMaxRetries(0))
+	t.Cleanup(func() { OpenAI = saved })
+}
+
+func siteBundle(title string) []VibeResponse {
+	return []VibeResponse{
+		{Type: "markdown", Filename: "README.md", Content: "# " + title + "\n\nOpen `index.html` in a browser.\n"},
+		{Type: "html", Filename: "index.html", Content: "<!DOCTYPE html>\n<html><head><title>" + title + "</title></head><body><h1>" + title + "</h1></body></html>\n"},
+	}
+}
+
+// fakeEvaluator records what rounds report to the evaluation URL.
+type fakeEvaluator struct {
+	URL string
+
+	mu   sync.Mutex
+	reqs []EvaluatorRequest
+}
+
+func newFakeEvaluator(t *testing.T) *fakeEvaluator {
+	t.Helper()
+
+	e := &fakeEvaluator{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req EvaluatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e.mu.Lock()
+		e.reqs = append(e.reqs, req)
+		e.mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	e.URL = srv.URL
+	return e
+}
+
+func (e *fakeEvaluator) last(t *testing.T) EvaluatorRequest {
+	t.Helper()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.reqs) == 0 {
+		t.Fatal("evaluator not notified")
+	}
+	return e.reqs[len(e.reqs)-1]
+}
+
+// roundPolicy sets the package-level round settings for one test.
+func roundPolicy(t *testing.T, replace ReplacePolicy, pullRequests bool) {
+	t.Helper()
+
+	savedReplace, savedPRs, savedTemplates := Replace, PullRequests, Templates
+	Replace, PullRequests, Templates = replace, pullRequests, nil
+	t.Cleanup(func() { Replace, PullRequests, Templates = savedReplace, savedPRs, savedTemplates })
+}
+
+type stageLog struct {
+	mu     sync.Mutex
+	stages []string
+}
+
+func (s *stageLog) report(stage string, eval EvaluatorRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stages = append(s.stages, stage)
+}
+
+func (s *stageLog) has(stage string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.stages {
+		if st == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func testRequest(eval *fakeEvaluator, round uint, nonce string) UserRequest {
+	return UserRequest{
+		Email:         "student@example.com",
+		Task:          "markdown-to-html-3f9a1",
+		Round:         round,
+		Nonce:         nonce,
+		Brief:         "Render Markdown as HTML. Show a preview.",
+		Checks:        []string{"Page has an h1"},
+		EvaluationURL: eval.URL,
+	}
+}
+
+func memoryFileData(t *testing.T, host *MemoryHost, repo, path string) string {
+	t.Helper()
+
+	_, data, err := host.GetFile(context.Background(), repo, path)
+	if err != nil {
+		t.Fatalf("%s/%s: %v", repo, path, err)
+	}
+	return string(data)
+}
+
+func memoryRelease(host *MemoryHost, repo, tag string) (Release, bool) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+
+	r, ok := host.repos[repo]
+	if !ok {
+		return Release{}, false
+	}
+	rel, ok := r.releases[tag]
+	return rel, ok
+}
+
+func TestRound1PublishesMarkedRepo(t *testing.T) {
+	roundPolicy(t, ReplaceReset, false)
+	fakeModel(t, siteBundle("Markdown to HTML"))
+	eval := newFakeEvaluator(t)
+
+	host := NewMemoryHost("tester")
+	req := testRequest(eval, 1, "n1")
+	stages := &stageLog{}
+
+	if err := Round1(context.Background(), host, req, stages.report); err != nil {
+		t.Fatal(err)
+	}
+
+	marker, err := ReadRepoMarker(context.Background(), host, req.Task)
+	if err != nil || marker == nil || marker.Request != requestHash(req) {
+		t.Fatalf("marker = %+v, %v", marker, err)
+	}
+	if !strings.Contains(memoryFileData(t, host, req.Task, "index.html"), buildStampTag(BuildStamp(req))) {
+		t.Fatal("index.html not stamped with the round's build")
+	}
+	if !strings.Contains(memoryFileData(t, host, req.Task, "LICENSE"), "MIT") {
+		t.Fatal("LICENSE missing")
+	}
+
+	got := eval.last(t)
+	sha, _ := host.LastCommit(context.Background(), req.Task)
+	if got.Round != 1 || got.CommitSHA != sha || got.RepoURL != host.RepoURL(req.Task) {
+		t.Fatalf("evaluator got %+v, want round 1 at %s", got, sha)
+	}
+
+	rel, ok := memoryRelease(host, req.Task, "round-1")
+	if !ok || rel.SHA != sha {
+		t.Fatalf("release round-1 = %+v, %v; want it at %s", rel, ok, sha)
+	}
+
+	for _, stage := range []string{"repo_created", "files_committed", "pages_built", "evaluator_notified", "released"} {
+		if !stages.has(stage) {
+			t.Errorf("stage %s not reported; got %v", stage, stages.stages)
+		}
+	}
+}
+
+func TestRound1ResumesRepoOfSameRequest(t *testing.T) {
+	roundPolicy(t, ReplaceRefuse, false)
+	fakeModel(t, siteBundle("Markdown to HTML"))
+	eval := newFakeEvaluator(t)
+
+	host := NewMemoryHost("tester")
+	req := testRequest(eval, 1, "n1")
+	ctx := context.Background()
+
+	if err := Round1(ctx, host, req, func(string, EvaluatorRequest) {}); err != nil {
+		t.Fatal(err)
+	}
+	// A retry of the same request picks the repo up even under refuse.
+	if err := Round1(ctx, host, req, func(string, EvaluatorRequest) {}); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+
+	// A different request for the same task is refused.
+	err := Round1(ctx, host, testRequest(eval, 1, "n2"), func(string, EvaluatorRequest) {})
+	if err == nil || !strings.Contains(err.Error(), "repo_exists") {
+		t.Fatalf("new request under refuse = %v, want repo_exists", err)
+	}
+}
+
+func TestRound1ReplacePolicies(t *testing.T) {
+	fakeModel(t, siteBundle("Markdown to HTML"))
+	eval := newFakeEvaluator(t)
+	ctx := context.Background()
+
+	// unmarked returns a host with an unrelated repo under the task's name.
+	unmarked := func(t *testing.T, task string) *MemoryHost {
+		t.Helper()
+
+		host := NewMemoryHost("tester")
+		if err := host.CreateRepository(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := host.Commit(ctx, task, "init", []FileChange{{Path: "notes.txt", Data: []byte("mine")}}); err != nil {
+			t.Fatal(err)
+		}
+		return host
+	}
+
+	// marked returns a host with a repo an earlier request created.
+	marked := func(t *testing.T) *MemoryHost {
+		t.Helper()
+
+		roundPolicy(t, ReplaceReset, false)
+		host := NewMemoryHost("tester")
+		if err := Round1(ctx, host, testRequest(eval, 1, "old"), func(string, EvaluatorRequest) {}); err != nil {
+			t.Fatal(err)
+		}
+		return host
+	}
+
+	req := testRequest(eval, 1, "new")
+
+	t.Run("unmarked", func(t *testing.T) {
+		for policy, want := range map[ReplacePolicy]error{
+			ReplaceRefuse:  nil,
+			ReplaceReset:   ErrNotManaged,
+			ReplaceArchive: ErrNotManaged,
+		} {
+			roundPolicy(t, policy, false)
+			host := unmarked(t, req.Task)
+
+			err := Round1(ctx, host, req, func(string, EvaluatorRequest) {})
+			if want != nil && !errors.Is(err, want) {
+				t.Errorf("%s: Round1 = %v, want %v", policy, err, want)
+			}
+			if want == nil && (err == nil || !strings.Contains(err.Error(), "repo_exists")) {
+				t.Errorf("%s: Round1 = %v, want repo_exists", policy, err)
+			}
+
+			if memoryFileData(t, host, req.Task, "notes.txt") != "mine" {
+				t.Errorf("%s: unmarked repo was changed", policy)
+			}
+			if repos, _ := host.ListRepositories(ctx); len(repos) != 1 {
+				t.Errorf("%s: %d repos, want the unmarked one only", policy, len(repos))
+			}
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		host := marked(t)
+		roundPolicy(t, ReplaceReset, false)
+
+		if err := Round1(ctx, host, req, func(string, EvaluatorRequest) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		marker, _ := ReadRepoMarker(ctx, host, req.Task)
+		if marker == nil || marker.Request != requestHash(req) {
+			t.Fatalf("marker after reset = %+v", marker)
+		}
+		host.mu.Lock()
+		commits := len(host.repos[req.Task].commits)
+		host.mu.Unlock()
+		if commits != 2 {
+			t.Fatalf("%d commits after reset, want the reset and the round", commits)
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		host := marked(t)
+		roundPolicy(t, ReplaceArchive, false)
+
+		if err := Round1(ctx, host, req, func(string, EvaluatorRequest) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		repos, _ := host.ListRepositories(ctx)
+		if len(repos) != 2 {
+			t.Fatalf("repos = %+v, want the archived one and a new one", repos)
+		}
+		if !strings.HasPrefix(repos[0].Name, req.Task+"-archived-") || repos[1].Name != req.Task {
+			t.Fatalf("repos = %s, %s", repos[0].Name, repos[1].Name)
+		}
+
+		old, _ := ReadRepoMarker(ctx, host, repos[0].Name)
+		if old == nil || old.Request != requestHash(testRequest(eval, 1, "old")) {
+			t.Fatalf("archived repo marker = %+v", old)
+		}
+	})
+}
+
+func TestRound2CommitsToDefaultBranch(t *testing.T) {
+	roundPolicy(t, ReplaceReset, false)
+	fakeModel(t, siteBundle("Round one"))
+	eval := newFakeEvaluator(t)
+
+	host := NewMemoryHost("tester")
+	ctx := context.Background()
+	if err := Round1(ctx, host, testRequest(eval, 1, "n1"), func(string, EvaluatorRequest) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeModel(t, siteBundle("Round two"))
+	req := testRequest(eval, 2, "n1")
+	if err := Round2(ctx, host, req, func(string, EvaluatorRequest) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	index := memoryFileData(t, host, req.Task, "index.html")
+	if !strings.Contains(index, "Round two") || !strings.Contains(index, buildStampTag(BuildStamp(req))) {
+		t.Fatalf("index.html not updated by round 2:\n%s", index)
+	}
+
+	sha, _ := host.LastCommit(ctx, req.Task)
+	if got := eval.last(t); got.Round != 2 || got.CommitSHA != sha {
+		t.Fatalf("evaluator got %+v, want round 2 at %s", got, sha)
+	}
+	if rel, ok := memoryRelease(host, req.Task, "round-2"); !ok || rel.SHA != sha {
+		t.Fatalf("release round-2 = %+v, %v", rel, ok)
+	}
+	if rel, ok := memoryRelease(host, req.Task, "round-1"); !ok || rel.SHA == sha {
+		t.Fatalf("release round-1 = %+v, %v; want it left on round 1's commit", rel, ok)
+	}
+}
+
+func TestRound2PullRequests(t *testing.T) {
+	eval := newFakeEvaluator(t)
+	ctx := context.Background()
+
+	setup := func(t *testing.T) *MemoryHost {
+		roundPolicy(t, ReplaceReset, true)
+		fakeModel(t, siteBundle("Round one"))
+
+		host := NewMemoryHost("tester")
+		if err := Round1(ctx, host, testRequest(eval, 1, "n1"), func(string, EvaluatorRequest) {}); err != nil {
+			t.Fatal(err)
+		}
+		return host
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		host := setup(t)
+		fakeModel(t, siteBundle("Round two"))
+		req := testRequest(eval, 2, "n1")
+		stages := &stageLog{}
+
+		if err := Round2(ctx, host, req, stages.report); err != nil {
+			t.Fatal(err)
+		}
+		if !stages.has("pull_request_opened") {
+			t.Fatalf("no pull request opened; stages %v", stages.stages)
+		}
+
+		host.mu.Lock()
+		open := len(host.repos[req.Task].pulls)
+		host.mu.Unlock()
+		if open != 0 {
+			t.Fatalf("%d pull requests left open", open)
+		}
+
+		sha, _ := host.LastCommit(ctx, req.Task)
+		if got := eval.last(t); got.CommitSHA != sha {
+			t.Fatalf("evaluator got %s, want the merge commit %s", got.CommitSHA, sha)
+		}
+		if !strings.Contains(memoryFileData(t, host, req.Task, "index.html"), "Round two") {
+			t.Fatal("merge did not reach the default branch")
+		}
+	})
+
+	t.Run("invalid bundle", func(t *testing.T) {
+		host := setup(t)
+		before, _ := host.LastCommit(ctx, "markdown-to-html-3f9a1")
+
+		bundle := siteBundle("Round two")
+		bundle[1].Type = "text"
+		fakeModel(t, bundle)
+		req := testRequest(eval, 2, "n1")
+
+		err := Round2(ctx, host, req, func(string, EvaluatorRequest) {})
+		if err == nil || !strings.Contains(err.Error(), "bundle_validation_failed") {
+			t.Fatalf("Round2 = %v, want bundle_validation_failed", err)
+		}
+
+		host.mu.Lock()
+		open := len(host.repos[req.Task].pulls)
+		host.mu.Unlock()
+		if open != 1 {
+			t.Fatalf("%d pull requests open, want the rejected one left for review", open)
+		}
+		if after, _ := host.LastCommit(ctx, req.Task); after != before {
+			t.Fatal("default branch moved although the bundle was invalid")
+		}
+		if _, ok := memoryRelease(host, req.Task, "round-2"); ok {
+			t.Fatal("round 2 released although it failed")
+		}
+	})
+}
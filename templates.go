@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Template is a scaffold round 1 starts from instead of an empty repo:
+// either a local directory whose files are copied into the first commit, or
+// a GitHub template repository the repo is generated from.
+type Template struct {
+	Name string `json:"name"`
+	// Dir is a local directory to copy, relative to the templates file.
+	Dir string `json:"dir,omitempty"`
+	// GitHub is a template repository, "owner/repo".
+	GitHub string `json:"github,omitempty"`
+	// Tasks is a regular expression picking the template by task name.
+	Tasks string `json:"tasks,omitempty"`
+	// Keywords pick the template for briefs that mention them.
+	Keywords []string `json:"keywords,omitempty"`
+	// Description tells the model what the scaffold is for.
+	Description string `json:"description,omitempty"`
+
+	tasks    *regexp.Regexp
+	keywords []*regexp.Regexp
+}
+
+// TemplateHost is implemented by hosts that can start a repo from a
+// template repository of their own.
+type TemplateHost interface {
+	// GenerateRepository creates name from template ("owner/repo"), with
+	// the template's files already on the default branch.
+	GenerateRepository(ctx context.Context, template, name string) error
+	// TemplateFiles returns the files on template's default branch.
+	TemplateFiles(ctx context.Context, template string) ([]FileChange, error)
+}
+
+// TemplateSet is the registered templates, in the order rules are tried,
+// and the one used when none matches ("" for none).
+type TemplateSet struct {
+	Default   string     `json:"default,omitempty"`
+	Templates []Template `json:"templates"`
+}
+
+// LoadTemplates reads a TemplateSet from a JSON file. An empty path means
+// no templates: every repo starts empty.
+func LoadTemplates(file string) (*TemplateSet, error) {
+	if file == "" {
+		return &TemplateSet{}, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read templates: %w", err)
+	}
+
+	var set TemplateSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse templates: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i := range set.Templates {
+		t := &set.Templates[i]
+
+		if t.Name == "" || names[t.Name] {
+			return nil, fmt.Errorf("invalid_template:%q: missing or duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		if (t.Dir == "") == (t.GitHub == "") {
+			return nil, fmt.Errorf("invalid_template:%s: set exactly one of dir and github", t.Name)
+		}
+
+		if t.Dir != "" {
+			if !filepath.IsAbs(t.Dir) {
+				t.Dir = filepath.Join(filepath.Dir(file), t.Dir)
+			}
+			if info, err := os.Stat(t.Dir); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("invalid_template:%s: %s is not a directory", t.Name, t.Dir)
+			}
+		}
+
+		if t.Tasks != "" {
+			if t.tasks, err = regexp.Compile(t.Tasks); err != nil {
+				return nil, fmt.Errorf("invalid_template:%s: %w", t.Name, err)
+			}
+		}
+
+		for _, kw := range t.Keywords {
+			t.keywords = append(t.keywords, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(kw)+`\b`))
+		}
+	}
+
+	if set.Default != "" && !names[set.Default] {
+		return nil, fmt.Errorf("invalid_template_default:%s", set.Default)
+	}
+
+	return &set, nil
+}
+
+// Check fails if a GitHub template is registered for a host that can't
+// generate repos from it.
+func (s *TemplateSet) Check(host RepoHost) error {
+	if _, ok := host.(TemplateHost); ok {
+		return nil
+	}
+
+	for _, t := range s.Templates {
+		if t.GitHub != "" {
+			return fmt.Errorf("template_needs_github:%s", t.Name)
+		}
+	}
+	return nil
+}
+
+// Pick returns the template for req, or nil to start from an empty repo.
+// The first template whose Tasks matches the task wins; failing that, the
+// one whose keywords the brief mentions most, with ties going to the
+// earlier one; failing that, the default.
+func (s *TemplateSet) Pick(req UserRequest) *Template {
+	if s == nil {
+		return nil
+	}
+
+	for i, t := range s.Templates {
+		if t.tasks != nil && t.tasks.MatchString(req.Task) {
+			return &s.Templates[i]
+		}
+	}
+
+	var best *Template
+	bestHits := 0
+	for i, t := range s.Templates {
+		hits := 0
+		for _, kw := range t.keywords {
+			if kw.MatchString(req.Brief) {
+				hits++
+			}
+		}
+		if hits > bestHits {
+			best, bestHits = &s.Templates[i], hits
+		}
+	}
+	if best != nil {
+		return best
+	}
+
+	for i, t := range s.Templates {
+		if t.Name == s.Default {
+			return &s.Templates[i]
+		}
+	}
+	return nil
+}
+
+// generatedFrom is the template repository claimRepo should generate a new
+// repo from on host, or "" to create it empty.
+func (t *Template) generatedFrom(host RepoHost) string {
+	if t == nil {
+		return ""
+	}
+	if _, ok := host.(TemplateHost); !ok {
+		return ""
+	}
+	return t.GitHub
+}
+
+// Files returns the scaffold: the directory's files, or those of the
+// GitHub template. The marker file is never taken from a template.
+func (t *Template) Files(ctx context.Context, host RepoHost) ([]FileChange, error) {
+	var files []FileChange
+	var err error
+
+	if t.Dir != "" {
+		files, err = readTemplateDir(t.Dir)
+	} else if th, ok := host.(TemplateHost); ok {
+		files, err = th.TemplateFiles(ctx, t.GitHub)
+	} else {
+		err = fmt.Errorf("template_needs_github:%s", t.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kept := files[:0]
+	for _, f := range files {
+		if f.Path != MarkerPath {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
+
+// readTemplateDir reads every regular file under dir, skipping .git.
+func readTemplateDir(dir string) ([]FileChange, error) {
+	var files []FileChange
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileChange{Path: filepath.ToSlash(rel), Data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read template %s: %w", dir, err)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("template_empty:" + dir)
+	}
+
+	return files, nil
+}
+
+// maxScaffoldFile and maxScaffold bound how much of a template the model is
+// shown; larger and binary files are only listed by name.
+const (
+	maxScaffoldFile = 32 << 10
+	maxScaffold     = 96 << 10
+)
+
+// scaffoldContext splits the template's files into those the model reads
+// and those it is only told about.
+func scaffoldContext(files []FileChange) (shown []VibeResponse, listed []string) {
+	total := 0
+	for _, f := range files {
+		if len(f.Data) > maxScaffoldFile || total+len(f.Data) > maxScaffold || !utf8.Valid(f.Data) {
+			listed = append(listed, f.Path)
+			continue
+		}
+
+		total += len(f.Data)
+		shown = append(shown, VibeResponse{
+			Type:     scaffoldType(f.Path),
+			Filename: f.Path,
+			Content:  string(f.Data),
+		})
+	}
+	return shown, listed
+}
+
+func scaffoldType(p string) string {
+	switch ext := strings.ToLower(path.Ext(p)); ext {
+	case ".md":
+		return "markdown"
+	case ".htm", ".html":
+		return "html"
+	case "":
+		return "text"
+	default:
+		return strings.TrimPrefix(ext, ".")
+	}
+}
+
+// mergeFiles keeps the last change to each path, in the order paths first
+// appear, so later sources override the template's files.
+func mergeFiles(files []FileChange) []FileChange {
+	index := map[string]int{}
+	merged := make([]FileChange, 0, len(files))
+
+	for _, f := range files {
+		if i, ok := index[f.Path]; ok {
+			merged[i] = f
+			continue
+		}
+		index[f.Path] = len(merged)
+		merged = append(merged, f)
+	}
+	return merged
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,7 +25,7 @@ func AsciiArt() {
 	myFigure := figure.NewFigure("1-SDT", "doom", true)
 	myFigure.Print()
 
-	fmt.Println("\n\t\t\tHayzam Sherif\n")
+	fmt.Print("\n\t\t\tHayzam Sherif\n\n")
 }
 
 func CreateLicense(owner string) string {
@@ -68,30 +73,59 @@ func StringArrToString(arr []string) string {
 	return result
 }
 
-func DecodeDataURL(s string) (DataURL, error) {
+// EncodedDataURL is a base64 data: URL that hasn't been decoded yet, so a
+// large one can be measured and streamed without a second copy in memory.
+type EncodedDataURL struct {
+	MIME    string
+	Payload string
+}
+
+func ParseDataURL(s string) (EncodedDataURL, error) {
 	if !strings.HasPrefix(s, "data:") {
-		return DataURL{}, errors.New("not a data: URL")
+		return EncodedDataURL{}, errors.New("not a data: URL")
 	}
 
 	parts := strings.SplitN(s, ",", 2)
 	if len(parts) != 2 {
-		return DataURL{}, errors.New("invalid data URL")
+		return EncodedDataURL{}, errors.New("invalid data URL")
 	}
 
 	meta, b64 := parts[0], parts[1]
 
 	if !strings.HasSuffix(meta, ";base64") {
-		return DataURL{}, errors.New("only base64 data URLs supported")
+		return EncodedDataURL{}, errors.New("only base64 data URLs supported")
 	}
 
 	mime := strings.TrimPrefix(strings.TrimSuffix(meta, ";base64"), "data:")
-	raw, err := base64.StdEncoding.DecodeString(b64)
+	return EncodedDataURL{MIME: mime, Payload: b64}, nil
+}
 
+// Size is the decoded size, worked out from the payload's length.
+func (d EncodedDataURL) Size() int64 {
+	n := int64(len(d.Payload)) / 4 * 3
+	return n - int64(len(d.Payload)-len(strings.TrimRight(d.Payload, "=")))
+}
+
+// Open streams the decoded content.
+func (d EncodedDataURL) Open() io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, strings.NewReader(d.Payload))
+}
+
+func (d EncodedDataURL) Decode() (DataURL, error) {
+	raw, err := base64.StdEncoding.DecodeString(d.Payload)
 	if err != nil {
 		return DataURL{}, err
 	}
 
-	return DataURL{MIME: mime, Data: raw}, nil
+	return DataURL{MIME: d.MIME, Data: raw}, nil
+}
+
+func DecodeDataURL(s string) (DataURL, error) {
+	du, err := ParseDataURL(s)
+	if err != nil {
+		return DataURL{}, err
+	}
+	return du.Decode()
 }
 
 func ToBase64Bytes(b []byte) string {
@@ -101,3 +135,97 @@ func ToBase64Bytes(b []byte) string {
 func FromBase64(s string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(s)
 }
+
+func EnvOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func EnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %s", key, v, def)
+		return def
+	}
+
+	return d
+}
+
+func EnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+
+	return n
+}
+
+// EnvSize reads a byte count, either plain or with a KB, MB or GB suffix
+// (powers of 1024), e.g. ATTACHMENT_MAX_SIZE=50MB.
+func EnvSize(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	num, unit := strings.ToUpper(strings.TrimSpace(v)), int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(num, suffix.name) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, suffix.name)), suffix.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+
+	return n * unit
+}
+
+func EnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %t", key, v, def)
+		return def
+	}
+
+	return b
+}
+
+// Sleep waits for d, returning early with the context's error if it is
+// cancelled first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultStageBudgets is how long a job may stay in a stage (i.e. since it
+// reported that stage) before the watchdog flags it as stuck. The name is the
+// stage the job is in, so "attachments_uploaded" covers the OpenAI call.
+var defaultStageBudgets = map[string]time.Duration{
+	"running":              2 * time.Minute,
+	"repo_created":         3 * time.Minute,
+	"files_loaded":         3 * time.Minute,
+	"attachments_uploaded": 6 * time.Minute,
+	"frontend_generated":   3 * time.Minute,
+	"pull_request_opened":  2 * time.Minute,
+	"files_committed":      3 * time.Minute,
+	"pages_built":          3 * time.Minute,
+}
+
+// defaultStageBudget applies to stages without an entry of their own.
+const defaultStageBudget = 5 * time.Minute
+
+// LoadStageBudgets reads STAGE_BUDGET_<STAGE> overrides on top of the
+// defaults, e.g. STAGE_BUDGET_ATTACHMENTS_UPLOADED=10m.
+func LoadStageBudgets() map[string]time.Duration {
+	budgets := map[string]time.Duration{}
+	for stage, def := range defaultStageBudgets {
+		budgets[stage] = EnvDuration("STAGE_BUDGET_"+strings.ToUpper(stage), def)
+	}
+	return budgets
+}
+
+func stageBudget(budgets map[string]time.Duration, stage string) time.Duration {
+	if d, ok := budgets[stage]; ok {
+		return d
+	}
+	return defaultStageBudget
+}
+
+// enterStage records that a running job reached a new stage.
+func (q *Queue) enterStage(id, stage string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if r, ok := q.running[id]; ok {
+		r.stage = stage
+		r.since = time.Now()
+		r.flagged = false
+	}
+}
+
+// watch periodically flags running jobs that have been in their current
+// stage for longer than its budget. Flagged jobs keep running; the flag shows
+// up as stuck_stage on the job and in the stuck count of the status payload.
+func (q *Queue) watch(ctx context.Context, budgets map[string]time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.flagStuck(budgets)
+		}
+	}
+}
+
+func (q *Queue) flagStuck(budgets map[string]time.Duration) {
+	type stuck struct {
+		id, stage string
+		elapsed   time.Duration
+	}
+
+	now := time.Now()
+	var found []stuck
+
+	q.mu.Lock()
+	for id, r := range q.running {
+		if r.flagged {
+			continue
+		}
+
+		if elapsed := now.Sub(r.since); elapsed > stageBudget(budgets, r.stage) {
+			r.flagged = true
+			found = append(found, stuck{id: id, stage: r.stage, elapsed: elapsed})
+		}
+	}
+	q.mu.Unlock()
+
+	for _, s := range found {
+		log.Printf("job_stuck: %s: in stage %q for %s (budget %s)",
+			s.id, s.stage, s.elapsed.Round(time.Second), stageBudget(budgets, s.stage))
+
+		q.update(s.id, func(rec *JobRecord) {
+			rec.StuckStage = s.stage
+		})
+	}
+}